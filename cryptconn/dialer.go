@@ -1,6 +1,7 @@
 package cryptconn
 
 import (
+	"context"
 	"crypto/cipher"
 	"net"
 
@@ -27,8 +28,12 @@ func NewDialer(dialer sutils.Dialer, method string, key string) (d *Dialer, err
 }
 
 func (d *Dialer) Dial(network, addr string) (conn net.Conn, err error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
 	log.Infof("Ctypt Dailer connect %s", addr)
-	conn, err = d.Dialer.Dial(network, addr)
+	conn, err = d.Dialer.DialContext(ctx, network, addr)
 	if err != nil {
 		return
 	}
@@ -8,6 +8,11 @@ import (
 type Listener struct {
 	net.Listener
 	block cipher.Block
+
+	// Check is called before handshake, conn will be closed if false.
+	Check func(net.Addr) bool
+	// OnError is called when handshake failed.
+	OnError func(net.Addr, error)
 }
 
 func NewListener(listener net.Listener, method string, key string) (l *Listener, err error) {
@@ -31,11 +36,22 @@ func (l *Listener) Accept() (conn net.Conn, err error) {
 			return
 		}
 
-		conn, err = NewServer(conn, l.block)
+		if l.Check != nil && !l.Check(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+
+		addr := conn.RemoteAddr()
+		raw := conn
+		conn, err = NewServer(raw, l.block)
 		if err == nil {
 			return
 		}
+		raw.Close()
 		log.Errorf("%s", err.Error())
+		if l.OnError != nil {
+			l.OnError(addr, err)
+		}
 	}
 	return
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/shell909090/goproxy/msocks"
+	"github.com/shell909090/goproxy/sutils"
+)
+
+var (
+	ErrNoDnsAnswer = errors.New("no dns answer")
+	ErrNoLocalDns  = errors.New("no local dns server for dnslocal")
+)
+
+type Exchanger interface {
+	Exchange(req *dns.Msg) (res *dns.Msg, err error)
+}
+
+// DnsServer answer dns queries from LAN. Queries are forwarded to remote
+// as they are, answers are cached by ttl in them, and ttl counted down
+// when answered from cache. Names match LocalRules (see
+// sutils.MatchHostRule) are sent to local servers directly, not cached.
+type DnsServer struct {
+	LocalRules []string
+
+	remote Exchanger
+	local  Exchanger
+	cache  *msocks.DnsCache
+}
+
+func NewDnsServer(remote, local Exchanger) (ds *DnsServer) {
+	return &DnsServer{
+		remote: remote,
+		local:  local,
+		cache:  msocks.NewDnsCache(),
+	}
+}
+
+func (ds *DnsServer) isLocal(host string) bool {
+	for _, rule := range ds.LocalRules {
+		if sutils.MatchHostRule(rule, host, "") {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup answer req by cache, or remote if not cached.
+func (ds *DnsServer) lookup(req *dns.Msg) (res *dns.Msg, err error) {
+	q := req.Question[0]
+	res = ds.cache.Get(q)
+	if res != nil {
+		return
+	}
+	res, err = ds.remote.Exchange(req)
+	if err != nil || res == nil {
+		return
+	}
+	ds.cache.Put(q, res)
+	return
+}
+
+// Exchange answer req, failed query get SERVFAIL.
+func (ds *DnsServer) Exchange(req *dns.Msg) (res *dns.Msg) {
+	if len(req.Question) != 1 {
+		res = new(dns.Msg)
+		res.SetRcode(req, dns.RcodeFormatError)
+		return
+	}
+	q := req.Question[0]
+	host := strings.TrimSuffix(strings.ToLower(q.Name), ".")
+
+	var err error
+	if ds.isLocal(host) {
+		log.Debugf("dns query for %s go local.", q.Name)
+		res, err = ds.local.Exchange(req)
+	} else {
+		res, err = ds.lookup(req)
+	}
+	if err == nil && res == nil {
+		err = ErrNoDnsAnswer
+	}
+	if err != nil {
+		log.Errorf("dns query for %s failed: %s", q.Name, err)
+		res = new(dns.Msg)
+		res.SetRcode(req, dns.RcodeServerFailure)
+		return
+	}
+	res.Id = req.Id
+	return
+}
+
+func (ds *DnsServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	res := ds.Exchange(req)
+
+	// udp response larger than client accepted should be truncated,
+	// client will retry in tcp.
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		res.Compress = true
+		if res.Len() > size {
+			res.Answer, res.Ns, res.Extra = nil, nil, nil
+			res.Truncated = true
+		}
+	}
+
+	err := w.WriteMsg(res)
+	if err != nil {
+		log.Errorf("%s", err)
+	}
+}
+
+// ListenAndServe serve dns in both udp and tcp on addr.
+func (ds *DnsServer) ListenAndServe(addr string) (err error) {
+	errc := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &dns.Server{Addr: addr, Net: network, Handler: ds}
+		go func() {
+			errc <- srv.ListenAndServe()
+		}()
+	}
+	log.Infof("dns server listening in %s", addr)
+	return <-errc
+}
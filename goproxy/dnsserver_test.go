@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// fakeExchanger answer every query with answers, or fail if answers is nil.
+type fakeExchanger struct {
+	answers []dns.RR
+	names   []string
+}
+
+func (fe *fakeExchanger) Exchange(req *dns.Msg) (res *dns.Msg, err error) {
+	fe.names = append(fe.names, req.Question[0].Name)
+	if fe.answers == nil {
+		return nil, errors.New("exchange failed")
+	}
+	res = new(dns.Msg)
+	res.SetReply(req)
+	res.Answer = fe.answers
+	return
+}
+
+// udpWriter record message written, as response to an udp client.
+type udpWriter struct {
+	dns.ResponseWriter
+	res *dns.Msg
+}
+
+func (w *udpWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5353}
+}
+
+func (w *udpWriter) WriteMsg(m *dns.Msg) error {
+	w.res = m
+	return nil
+}
+
+func txtAnswer(name string, n int) (rrs []dns.RR) {
+	for i := 0; i < n; i++ {
+		rrs = append(rrs, &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{strings.Repeat("a", 200)},
+		})
+	}
+	return
+}
+
+func TestDnsServerRoute(t *testing.T) {
+	remote := &fakeExchanger{answers: txtAnswer("example.com.", 1)}
+	local := &fakeExchanger{answers: txtAnswer("nas.lan.", 1)}
+	ds := NewDnsServer(remote, local)
+	ds.LocalRules = []string{"*.lan"}
+
+	req := new(dns.Msg)
+	req.SetQuestion("NAS.lan.", dns.TypeA)
+	res := ds.Exchange(req)
+	if res.Rcode != dns.RcodeSuccess || len(local.names) != 1 || len(remote.names) != 0 {
+		t.Fatalf("name match dnslocal should go local, got %v", res)
+	}
+
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	ds.Exchange(req)
+	req.SetQuestion("other.com.", dns.TypeA)
+	ds.Exchange(req)
+	if len(remote.names) != 2 || len(local.names) != 1 {
+		t.Fatalf("other names should be forwarded: %v", remote.names)
+	}
+}
+
+func TestDnsServerCache(t *testing.T) {
+	remote := &fakeExchanger{answers: []dns.RR{
+		&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+			Target: "cdn.example.net.",
+		},
+		&dns.A{
+			Hdr: dns.RR_Header{Name: "cdn.example.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 20},
+			A:   net.ParseIP("192.0.2.1"),
+		},
+	}}
+	ds := NewDnsServer(remote, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	res := ds.Exchange(req)
+	if len(res.Answer) != 2 || res.Id != req.Id {
+		t.Fatalf("answer of remote should be returned as it is, got %v", res)
+	}
+
+	req.Id = dns.Id()
+	res = ds.Exchange(req)
+	if len(remote.names) != 1 {
+		t.Fatalf("answer cached should not be forwarded")
+	}
+	if _, ok := res.Answer[0].(*dns.CNAME); !ok || len(res.Answer) != 2 || res.Id != req.Id {
+		t.Fatalf("cname chain lost in cache, got %v", res)
+	}
+	if ttl := res.Answer[1].Header().Ttl; ttl > 20 {
+		t.Fatalf("ttl of upstream should be kept, got %d", ttl)
+	}
+}
+
+func TestDnsServerServfail(t *testing.T) {
+	ds := NewDnsServer(&fakeExchanger{}, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	res := ds.Exchange(req)
+	if res.Rcode != dns.RcodeServerFailure || res.Id != req.Id || !res.Response {
+		t.Fatalf("failed query should get SERVFAIL, got %v", res)
+	}
+
+	req.Question = append(req.Question, req.Question[0])
+	if res = ds.Exchange(req); res.Rcode != dns.RcodeFormatError {
+		t.Fatalf("multiple questions should get FORMERR, got %v", res)
+	}
+}
+
+func TestDnsServerTruncate(t *testing.T) {
+	remote := &fakeExchanger{answers: txtAnswer("example.com.", 10)}
+	ds := NewDnsServer(remote, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	w := &udpWriter{}
+	ds.ServeDNS(w, req)
+	if !w.res.Truncated || len(w.res.Answer) != 0 || w.res.Rcode != dns.RcodeSuccess {
+		t.Fatalf("udp response too large should be truncated, got %v", w.res)
+	}
+
+	// client accept larger response by edns0.
+	remote.answers = txtAnswer("example.com.", 10)
+	req.SetEdns0(4096, false)
+	ds.ServeDNS(w, req)
+	if w.res.Truncated || len(w.res.Answer) != 10 {
+		t.Fatalf("response in size of edns0 should not be truncated, got %v", w.res)
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 	logging "github.com/op/go-logging"
 
+	"github.com/shell909090/goproxy/msocks"
 	"github.com/shell909090/goproxy/sutils"
 )
 
@@ -16,6 +17,9 @@ var log = logging.MustGetLogger("")
 
 const TypeInternal = "internal"
 
+// Version is reported to server, can be set by -ldflags "-X main.Version=x".
+var Version = "2.4.1"
+
 var (
 	ConfigFile string
 )
@@ -32,12 +36,40 @@ type Config struct {
 	DnsNet   string
 
 	Cipher string
+
+	MaxBuffer     int64
+	MaxSessBuffer int64
+
+	ShutdownTimeout int
 }
 
 type ServerConfig struct {
 	Config
-	Key  string
-	Auth map[string]string
+	Key       string
+	Auth      map[string]string
+	BindPorts map[string]string
+
+	Upstream      []*ServerDefine
+	UpstreamRules []string
+
+	ACL    map[string]*msocks.ACL
+	Limits map[string]*msocks.Limit
+
+	BanFails     int
+	BanWindow    int
+	BanTime      int
+	BanMax       int
+	AuthMaxDelay int
+
+	AccountFile string
+
+	AuditFile     string
+	AuditMaxSize  int64
+	AuditMaxFiles int
+	AuditHashKey  string
+
+	DnsPrefer  string
+	DnsBlocked []string
 }
 
 type ServerDefine struct {
@@ -46,6 +78,9 @@ type ServerDefine struct {
 	Key      string
 	Username string
 	Password string
+	Group    string
+	Priority int
+	Class    string
 }
 
 type PortMap struct {
@@ -58,19 +93,37 @@ type ClientConfig struct {
 	Config
 	Blackfile string
 
-	MinSess int
-	MaxConn int
-	Servers []*ServerDefine
+	MinSess     int
+	MaxConn     int
+	MaxSess     int
+	IdleTimeout int
+	MaxAge      int
+	FastOpen    bool
+	DialRetry   int
+	RetryAll    bool
+	Servers     []*ServerDefine
+
+	BulkMinSess   int
+	BulkMaxConn   int
+	BulkThreshold int64
+	BulkRules     []string
 
 	HttpUser     string
 	HttpPassword string
 
-	Portmaps []PortMap
+	// report version and hostname in auth, old servers can't parse it.
+	ReportVersion bool
+
+	Portmaps   []PortMap
+	RemoteMaps []PortMap
+
+	DnsServer       string
+	DnsLocal        []string
+	DnsLocalServers []string
 }
 
 func init() {
 	flag.StringVar(&ConfigFile, "config", "config.json", "config file")
-	flag.Parse()
 }
 
 func LoadJson(configfile string, cfg interface{}) (err error) {
@@ -115,6 +168,9 @@ func LoadConfig() (cfg Config, err error) {
 	if cfg.Cipher == "" {
 		cfg.Cipher = "aes"
 	}
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = 30
+	}
 	return
 }
 
@@ -144,6 +200,7 @@ func SetLogging(cfg Config) (err error) {
 }
 
 func main() {
+	flag.Parse()
 	cfg, err := LoadConfig()
 	if err != nil {
 		fmt.Println(err.Error())
@@ -170,8 +227,16 @@ func main() {
 		log.Info("unknown mode")
 		return
 	}
-	if err != nil {
+	sutils.StopUpdater()
+
+	switch err {
+	case nil:
+		log.Info("server stopped")
+	case msocks.ErrShutdownTimeout:
+		log.Warningf("%s", err)
+		os.Exit(2)
+	default:
 		log.Errorf("%s", err)
+		os.Exit(1)
 	}
-	log.Info("server stopped")
 }
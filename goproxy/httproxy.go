@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
+	"net"
 	"net/http"
 	"strings"
 
+	"github.com/shell909090/goproxy/msocks"
 	"github.com/shell909090/goproxy/sutils"
 )
 
@@ -30,7 +33,7 @@ func NewProxy(dialer sutils.Dialer, username string, password string) (p *Proxy)
 		username:  username,
 		password:  password,
 		dialer:    dialer,
-		transport: http.Transport{Dial: dialer.Dial},
+		transport: http.Transport{DialContext: dialer.DialContext},
 	}
 	if username != "" && password != "" {
 		log.Info("proxy-auth required")
@@ -38,6 +41,35 @@ func NewProxy(dialer sutils.Dialer, username string, password string) (p *Proxy)
 	return
 }
 
+// map dial error to http status code.
+func errorStatus(err error) int {
+	var de *msocks.DialError
+	if errors.As(err, &de) {
+		switch de.Errno {
+		case msocks.ERR_TIMEOUT:
+			return http.StatusGatewayTimeout
+		case msocks.ERR_DENIED, msocks.ERR_FORBIDDEN, msocks.ERR_QUOTA:
+			return http.StatusForbidden
+		case msocks.ERR_CLOSED:
+			return http.StatusServiceUnavailable
+		case msocks.ERR_LIMIT:
+			return http.StatusTooManyRequests
+		}
+		return http.StatusBadGateway
+	}
+
+	var neterr net.Error
+	if errors.As(err, &neterr) && neterr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+
+	switch err {
+	case msocks.ErrNoSession, msocks.ErrNoServer:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -73,7 +105,7 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	resp, err := p.transport.RoundTrip(req)
 	if err != nil {
 		log.Errorf("%s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 	defer resp.Body.Close()
@@ -84,6 +116,10 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	_, err = sutils.CoreCopy(w, resp.Body)
 	if err != nil {
 		log.Errorf("%s", err)
+		if err == msocks.ErrStreamReset {
+			// response is half sent, abort client connection.
+			panic(http.ErrAbortHandler)
+		}
 		return
 	}
 	return
@@ -95,25 +131,71 @@ func (p *Proxy) Connect(w http.ResponseWriter, r *http.Request) {
 		log.Error("httpserver does not support hijacking")
 		return
 	}
-	srcconn, _, err := hij.Hijack()
-	if err != nil {
-		log.Error("Cannot hijack connection ", err)
-		return
-	}
-	defer srcconn.Close()
 
 	host := r.URL.Host
 	if !strings.Contains(host, ":") {
 		host += ":80"
 	}
-	dstconn, err := p.dialer.Dial("tcp", host)
+
+	// dial before hijack, so client gone will cancel the dial.
+	dstconn, err := p.dialer.DialContext(r.Context(), "tcp", host)
+	if err == nil {
+		// in fast open, wait for result before 200, so failure can be
+		// told by status. client will not send anything before it.
+		if dw, ok := dstconn.(dialWaiter); ok {
+			err = dw.WaitDial()
+			if err != nil {
+				dstconn.Close()
+			}
+		}
+	}
 	if err != nil {
 		log.Errorf("dial failed: %s", err.Error())
-		srcconn.Write([]byte("HTTP/1.0 502 OK\r\n\r\n"))
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	srcconn, _, err := hij.Hijack()
+	if err != nil {
+		log.Error("Cannot hijack connection ", err)
+		dstconn.Close()
 		return
 	}
+	defer srcconn.Close()
 	srcconn.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 
-	sutils.CopyLink(srcconn, dstconn)
+	copyLink(srcconn, dstconn)
 	return
 }
+
+type dialWaiter interface {
+	WaitDial() error
+}
+
+type aborter interface {
+	Abort() error
+}
+
+// Like sutils.CopyLink, but reset on one side will reset the other.
+func copyLink(srcconn, dstconn net.Conn) {
+	go func() {
+		defer dstconn.Close()
+		_, err := sutils.CoreCopy(dstconn, srcconn)
+		if err == nil {
+			return
+		}
+		if a, ok := dstconn.(aborter); ok {
+			log.Infof("client connection broken: %s, abort remote.", err)
+			a.Abort()
+		}
+	}()
+	defer srcconn.Close()
+	_, err := sutils.CoreCopy(srcconn, dstconn)
+	if err != msocks.ErrStreamReset {
+		return
+	}
+	if tcpconn, ok := srcconn.(*net.TCPConn); ok {
+		log.Infof("remote reset, reset client connection.")
+		tcpconn.SetLinger(0)
+	}
+}
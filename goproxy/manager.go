@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/pprof"
+	"strings"
 	"text/template"
 
 	"github.com/shell909090/goproxy/msocks"
@@ -30,21 +32,48 @@ const (
 	  </form>
 	</td>
       </tr>
+      <tr>
+	<td>buffered: {{.GetBuffered}}/{{.GetBufferLimit}}</td>
+      </tr>
+      <tr>
+	<td>bulk hosts: {{range .GetBulkHosts}}{{.}} {{end}}</td>
+      </tr>
+    </table>
+    <table>
+      <tr>
+	<th>Server</th><th>Group</th><th>Priority</th><th>Class</th>
+	<th>Score</th><th>State</th><th>Health</th>
+      </tr>
+      {{range $asf := .GetFactories}}
+      <tr>
+	<td>{{$asf.String}}</td>
+	<td>{{$asf.Group}}</td>
+	<td>{{$asf.Priority}}</td>
+	<td>{{$asf.Class}}</td>
+	<td>{{printf "%.1f" $asf.Health.Score}}</td>
+	<td>{{$asf.Health.State}}</td>
+	<td>{{$asf.Health.String}}</td>
+      </tr>
+      {{end}}
     </table>
     <table>
       <tr>
 	<th>Sess</th><th>Id</th><th>State</th>
-        <th>Recv-Q</th><th>Send-Q</th><th width="50%">Target</th>
+        <th>Recv-Q</th><th>Send-Q</th><th>Buffered</th><th width="50%">Target</th>
       </tr>
       {{if .GetSize}}
       {{range $sess, $non := .GetSessions}}
       <tr>
 	<td>{{$sess.String}}</td>
-	<td></td>
-	<td>{{$sess.GetSize}}</td>
+	<td>{{$sess.Class}}</td>
+	<td>{{$sess.GetSize}}{{if $sess.IsSuspect}} suspect{{end}}{{if $sess.IsRotating}} rotating{{end}}</td>
 	<td>{{$sess.Readcnt.Spd}}</td>
 	<td>{{$sess.Writecnt.Spd}}</td>
-	<td>{{$sess.RemoteAddr}}</td>
+	<td>{{$sess.GetBuffered}}</td>
+	<td>{{$sess.RemoteAddr}} => {{$sess.Server}} rtt: {{$sess.GetRTT}}
+	  since {{$sess.GetCreated.Format "2006-01-02 15:04:05"}}
+	  {{if $sess.Username}}user: {{$sess.Username}}{{end}}
+	  {{if $sess.Version}}client: {{$sess.Version}}@{{$sess.Hostname}}{{end}}</td>
       </tr>
       {{range $conn := $sess.GetSortedPorts}}
       <tr>
@@ -54,6 +83,7 @@ const (
 	<td>{{$conn.GetStatus}}</td>
 	<td>{{$conn.GetReadBufSize}}</td>
 	<td>{{$conn.GetWriteBufSize}}</td>
+	<td></td>
 	<td>{{$conn.GetAddress}}</td>
 	{{else}}
 	<td></td>
@@ -67,6 +97,58 @@ const (
       {{end}}
     </table>
   </body>
+</html>`
+	str_users = `
+<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 4.01//EN" "http://www.w3.org/TR/html4/strict.dtd">
+<html>
+  <head>
+    <title>user list</title>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+    <meta name="author" content="Shell.Xu">
+  </head>
+  <body>
+    <table>
+      <tr>
+	<th>User</th><th>Sessions</th><th>Streams</th><th>Traffic</th>
+      </tr>
+      {{range $st := .GetUserStats}}
+      <tr>
+	<td>{{$st.Username}}</td>
+	<td>{{$st.Sessions}}</td>
+	<td>{{$st.Streams}}</td>
+	<td>{{with $st.Usage}}{{.String}}{{else}}no limit{{end}}</td>
+      </tr>
+      {{else}}
+      <tr><td>no user</td></tr>
+      {{end}}
+    </table>
+  </body>
+</html>`
+	str_bans = `
+<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 4.01//EN" "http://www.w3.org/TR/html4/strict.dtd">
+<html>
+  <head>
+    <title>ban list</title>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+    <meta name="author" content="Shell.Xu">
+  </head>
+  <body>
+    <table>
+      <tr>
+	<th>IP</th><th>Until</th>
+	<th><form method="post" action="bans/clear"><input type="submit" value="clear all"></form></th>
+      </tr>
+      {{range $ban := .}}
+      <tr>
+	<td>{{$ban.IP}}</td>
+	<td>{{$ban.Until.Format "2006-01-02 15:04:05"}}</td>
+	<td><form method="post" action="bans/clear"><input type="hidden" name="ip" value="{{$ban.IP}}"><input type="submit" value="clear"></form></td>
+      </tr>
+      {{else}}
+      <tr><td>no ban</td></tr>
+      {{end}}
+    </table>
+  </body>
 </html>`
 	str_addrs = `
 <!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 4.01//EN" "http://www.w3.org/TR/html4/strict.dtd">
@@ -89,8 +171,10 @@ const (
 )
 
 var (
-	tmpl_sess *template.Template
-	tmpl_addr *template.Template
+	tmpl_sess  *template.Template
+	tmpl_addr  *template.Template
+	tmpl_users *template.Template
+	tmpl_bans  *template.Template
 )
 
 func init() {
@@ -103,10 +187,20 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	tmpl_users, err = template.New("users").Parse(str_users)
+	if err != nil {
+		panic(err)
+	}
+	tmpl_bans, err = template.New("bans").Parse(str_bans)
+	if err != nil {
+		panic(err)
+	}
 }
 
 type MsocksManager struct {
 	sp *msocks.SessionPool
+	// svr is set in server mode only.
+	svr *msocks.MsocksServer
 }
 
 func NewMsocksManager(sp *msocks.SessionPool) (mm *MsocksManager) {
@@ -120,6 +214,12 @@ func (mm *MsocksManager) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/", mm.HandlerMain)
 	mux.HandleFunc("/lookup", mm.HandlerLookup)
 	mux.HandleFunc("/cutoff", mm.HandlerCutoff)
+	if mm.svr != nil {
+		mux.HandleFunc("/users", mm.HandlerUsers)
+		mux.HandleFunc("/bans", mm.HandlerBans)
+		mux.HandleFunc("/bans/clear", mm.HandlerBansClear)
+		mux.HandleFunc("/accounting", mm.HandlerAccounting)
+	}
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
@@ -134,6 +234,69 @@ func (mm *MsocksManager) HandlerMain(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
+func (mm *MsocksManager) HandlerUsers(w http.ResponseWriter, req *http.Request) {
+	err := tmpl_users.Execute(w, mm.svr)
+	if err != nil {
+		log.Errorf("%s", err)
+	}
+	return
+}
+
+func (mm *MsocksManager) HandlerBans(w http.ResponseWriter, req *http.Request) {
+	err := tmpl_bans.Execute(w, mm.svr.Guard.GetBans())
+	if err != nil {
+		log.Errorf("%s", err)
+	}
+	return
+}
+
+// HandlerBansClear clear ban of ip in form, or all bans if no ip.
+// POST only, so links or prefetch will not clear bans.
+func (mm *MsocksManager) HandlerBansClear(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mm.svr.Guard.Unban(req.FormValue("ip"))
+	http.Redirect(w, req, "/bans", http.StatusSeeOther)
+	return
+}
+
+// HandlerAccounting return traffic records in json. Query can be user,
+// host, from and to day, and by, like "by=user,day".
+func (mm *MsocksManager) HandlerAccounting(w http.ResponseWriter, req *http.Request) {
+	if mm.svr.Accounting == nil {
+		http.Error(w, "accounting not enabled", http.StatusNotFound)
+		return
+	}
+
+	q := req.URL.Query()
+	f := &msocks.AccountFilter{
+		User: q.Get("user"),
+		Host: q.Get("host"),
+		From: q.Get("from"),
+		To:   q.Get("to"),
+	}
+	if by := q.Get("by"); by != "" {
+		f.By = strings.Split(by, ",")
+	}
+
+	records, err := mm.svr.Accounting.Query(f)
+	if err != nil {
+		log.Errorf("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(records)
+	if err != nil {
+		log.Errorf("%s", err)
+	}
+	return
+}
+
 func (mm *MsocksManager) HandlerLookup(w http.ResponseWriter, req *http.Request) {
 	q := req.URL.Query()
 	hosts, ok := q["host"]
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/shell909090/goproxy/cryptconn"
 	"github.com/shell909090/goproxy/ipfilter"
@@ -20,34 +25,166 @@ func httpserver(addr string, handler http.Handler) {
 	}
 }
 
+// runUntilSignal run serve, until it quit or SIGTERM/SIGINT got.
+// For signal, shutdown will be called, and serve should quit by it.
+func runUntilSignal(serve func() error, shutdown func() error) (err error) {
+	errch := make(chan error, 1)
+	go func() {
+		errch <- serve()
+	}()
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigch)
+
+	select {
+	case err = <-errch:
+		return
+	case sig := <-sigch:
+		log.Noticef("got signal %s, shutting down.", sig)
+	}
+
+	err = shutdown()
+	serr := <-errch
+	if err == nil && serr != http.ErrServerClosed {
+		err = serr
+	}
+	return
+}
+
 func run_server(basecfg *Config) (err error) {
 	cfg, err := LoadServerConfig(basecfg)
 	if err != nil {
 		return
 	}
 
-	listener, err := net.Listen("tcp", cfg.Listen)
+	rawlistener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return
+	}
+
+	listener, err := cryptconn.NewListener(rawlistener, cfg.Cipher, cfg.Key)
+	if err != nil {
+		return
+	}
+
+	var dialer sutils.Dialer = sutils.DefaultTcpDialer
+	var upstream *msocks.SessionPool
+	if len(cfg.Upstream) > 0 {
+		upstream = msocks.CreateSessionPool(0, 0)
+		err = addServers(upstream, cfg.Upstream, cfg.Cipher)
+		if err != nil {
+			return
+		}
+		dialer = upstream
+		if len(cfg.UpstreamRules) > 0 {
+			dialer = &sutils.RuleDialer{
+				Rules:   cfg.UpstreamRules,
+				Matched: upstream,
+				Default: sutils.DefaultTcpDialer,
+			}
+		}
+	}
+
+	svr, err := msocks.NewServer(cfg.Auth, dialer)
 	if err != nil {
 		return
 	}
+	svr.SetBufferLimit(cfg.MaxBuffer, cfg.MaxSessBuffer)
 
-	listener, err = cryptconn.NewListener(listener, cfg.Cipher, cfg.Key)
+	err = svr.SetBindPorts(cfg.BindPorts)
 	if err != nil {
 		return
 	}
 
-	svr, err := msocks.NewServer(cfg.Auth, sutils.DefaultTcpDialer)
+	err = svr.SetACL(cfg.ACL)
 	if err != nil {
 		return
 	}
+	svr.SetLimits(cfg.Limits)
+
+	if cfg.BanFails != 0 {
+		svr.Guard.MaxFails = cfg.BanFails
+	}
+	if cfg.BanWindow != 0 {
+		svr.Guard.Window = time.Duration(cfg.BanWindow) * time.Second
+	}
+	if cfg.BanTime != 0 {
+		svr.Guard.BanTime = time.Duration(cfg.BanTime) * time.Second
+	}
+	if cfg.BanMax != 0 {
+		svr.Guard.MaxRecords = cfg.BanMax
+	}
+	if cfg.AuthMaxDelay != 0 {
+		svr.Guard.MaxDelay = time.Duration(cfg.AuthMaxDelay) * time.Second
+	}
+	svr.Resolver.Prefer = cfg.DnsPrefer
+	svr.Resolver.Blocked = cfg.DnsBlocked
+
+	listener.Check = svr.Guard.Allow
+	listener.OnError = svr.Guard.Fail
+
+	if cfg.AccountFile != "" {
+		svr.Accounting, err = msocks.NewAccounting(cfg.AccountFile)
+		if err != nil {
+			return
+		}
+	}
+
+	if cfg.AuditFile != "" {
+		svr.Audit, err = msocks.NewAuditLog(cfg.AuditFile)
+		if err != nil {
+			return
+		}
+		if cfg.AuditMaxSize != 0 {
+			svr.Audit.MaxSize = cfg.AuditMaxSize * 1024 * 1024
+		}
+		if cfg.AuditMaxFiles != 0 {
+			svr.Audit.MaxFiles = cfg.AuditMaxFiles
+		}
+		svr.Audit.HashKey = cfg.AuditHashKey
+	}
 
 	if cfg.AdminIface != "" {
 		mux := http.NewServeMux()
-		NewMsocksManager(svr.SessionPool).Register(mux)
+		mm := NewMsocksManager(svr.SessionPool)
+		mm.svr = svr
+		mm.Register(mux)
 		go httpserver(cfg.AdminIface, mux)
 	}
 
-	return svr.Serve(listener)
+	timeout := time.Duration(cfg.ShutdownTimeout) * time.Second
+	return runUntilSignal(func() error {
+		return svr.Serve(listener)
+	}, func() (err error) {
+		start := time.Now()
+		err = svr.Shutdown(timeout)
+		if upstream != nil {
+			uerr := upstream.Shutdown(timeout - time.Since(start))
+			if err == nil {
+				err = uerr
+			}
+		}
+		return
+	})
+}
+
+// addServers add servers into pool, cipher is default if server not set.
+func addServers(sp *msocks.SessionPool, servers []*ServerDefine, cipher string) (err error) {
+	for _, srv := range servers {
+		c := srv.Cipher
+		if c == "" {
+			c = cipher
+		}
+		var dialer sutils.Dialer
+		dialer, err = cryptconn.NewDialer(sutils.DefaultTcpDialer, c, srv.Key)
+		if err != nil {
+			return
+		}
+		sf := sp.AddSessionFactory(dialer, srv.Server, srv.Username, srv.Password)
+		sf.Group, sf.Priority, sf.Class = srv.Group, srv.Priority, srv.Class
+	}
+	return
 }
 
 func run_httproxy(basecfg *Config) (err error) {
@@ -58,21 +195,40 @@ func run_httproxy(basecfg *Config) (err error) {
 
 	var dialer sutils.Dialer
 	sp := msocks.CreateSessionPool(cfg.MinSess, cfg.MaxConn)
+	sp.SetBufferLimit(cfg.MaxBuffer, cfg.MaxSessBuffer)
+	sp.FastOpen = cfg.FastOpen
+	sp.MaxSess = cfg.MaxSess
+	sp.IdleTimeout = time.Duration(cfg.IdleTimeout) * time.Second
+	sp.MaxAge = time.Duration(cfg.MaxAge) * time.Second
+	sp.BulkMinSess = cfg.BulkMinSess
+	if cfg.BulkMaxConn != 0 {
+		sp.BulkMaxConn = cfg.BulkMaxConn
+	}
+	sp.BulkThreshold = cfg.BulkThreshold
+	sp.SetBulkRules(cfg.BulkRules)
+	sp.RetryAll = cfg.RetryAll
+	if cfg.DialRetry != 0 {
+		sp.DialRetry = cfg.DialRetry
+	}
 
-	for _, srv := range cfg.Servers {
-		cipher := srv.Cipher
-		if cipher == "" {
-			cipher = cfg.Cipher
-		}
-		dialer, err = cryptconn.NewDialer(sutils.DefaultTcpDialer, cipher, srv.Key)
-		if err != nil {
-			return
-		}
-		sp.AddSessionFactory(dialer, srv.Server, srv.Username, srv.Password)
+	if cfg.ReportVersion {
+		msocks.ClientVersion = "goproxy/" + Version
+		msocks.ClientHostname, _ = os.Hostname()
+	}
+
+	err = addServers(sp, cfg.Servers, cfg.Cipher)
+	if err != nil {
+		return
 	}
 
 	dialer = sp
 
+	// local dns servers, before DefaultLookuper replaced by internal.
+	local, _ := sutils.DefaultLookuper.(*sutils.DnsLookup)
+	if len(cfg.DnsLocalServers) > 0 {
+		local = sutils.NewDnsLookup(cfg.DnsLocalServers, "")
+	}
+
 	if cfg.DnsNet == TypeInternal {
 		sutils.DefaultLookuper = sp
 	}
@@ -97,5 +253,42 @@ func run_httproxy(basecfg *Config) (err error) {
 		go CreatePortmap(pm, dialer)
 	}
 
-	return http.ListenAndServe(cfg.Listen, NewProxy(dialer, cfg.HttpUser, cfg.HttpPassword))
+	if cfg.DnsServer != "" {
+		if local == nil && len(cfg.DnsLocal) > 0 {
+			return ErrNoLocalDns
+		}
+		ds := NewDnsServer(sp, local)
+		ds.LocalRules = cfg.DnsLocal
+		go func() {
+			err := ds.ListenAndServe(cfg.DnsServer)
+			if err != nil {
+				log.Errorf("%s", err.Error())
+			}
+		}()
+	}
+
+	for _, rm := range cfg.RemoteMaps {
+		sp.AddRemoteBind(rm.Net, rm.Src, rm.Dst, sutils.DefaultTcpDialer)
+	}
+
+	srv := &http.Server{
+		Addr:    cfg.Listen,
+		Handler: NewProxy(dialer, cfg.HttpUser, cfg.HttpPassword),
+	}
+	timeout := time.Duration(cfg.ShutdownTimeout) * time.Second
+	return runUntilSignal(srv.ListenAndServe, func() (err error) {
+		// http requests first, then streams in tunnels left.
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		herr := srv.Shutdown(ctx)
+		if herr != nil {
+			log.Errorf("%s", herr)
+		}
+		err = sp.Shutdown(timeout - time.Since(start))
+		if err == nil && herr != nil {
+			err = msocks.ErrShutdownTimeout
+		}
+		return
+	})
 }
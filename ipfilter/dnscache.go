@@ -4,6 +4,7 @@ import (
 	"errors"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/shell909090/goproxy/sutils"
 )
@@ -12,40 +13,66 @@ const maxCache = 512
 
 var errType = errors.New("type error")
 
+type cacheEntry struct {
+	addrs  []net.IP
+	expire time.Time
+}
+
+// DNSCache cache addresses of hostname. Entries expire after TTL, or never
+// if TTL is 0. Lookuper is used when missed, sutils.DefaultLookuper if nil.
 type DNSCache struct {
+	Lookuper sutils.Lookuper
+	TTL      time.Duration
+
 	mu    sync.Mutex
 	cache *Cache
 }
 
 func CreateDNSCache() (dc *DNSCache) {
+	return NewDNSCache(nil)
+}
+
+func NewDNSCache(lookuper sutils.Lookuper) (dc *DNSCache) {
 	dc = &DNSCache{
-		cache: New(maxCache),
+		Lookuper: lookuper,
+		cache:    New(maxCache),
 	}
 	return
 }
 
-func (dc DNSCache) LookupIP(hostname string) (addrs []net.IP, err error) {
+func (dc *DNSCache) LookupIP(hostname string) (addrs []net.IP, err error) {
 	dc.mu.Lock()
 	value, ok := dc.cache.Get(hostname)
 	dc.mu.Unlock()
 
 	if ok {
-		addrs, ok = value.([]net.IP)
+		e, ok := value.(*cacheEntry)
 		if !ok {
 			err = errType
+			return
+		}
+		if e.expire.IsZero() || time.Now().Before(e.expire) {
+			log.Debugf("hostname %s cached.", hostname)
+			return e.addrs, nil
 		}
-		log.Debugf("hostname %s cached.", hostname)
-		return
 	}
 
-	addrs, err = sutils.DefaultLookuper.LookupIP(hostname)
+	lookuper := dc.Lookuper
+	if lookuper == nil {
+		lookuper = sutils.DefaultLookuper
+	}
+	addrs, err = lookuper.LookupIP(hostname)
 	if err != nil {
 		return
 	}
 
 	if len(addrs) > 0 {
+		e := &cacheEntry{addrs: addrs}
+		if dc.TTL > 0 {
+			e.expire = time.Now().Add(dc.TTL)
+		}
 		dc.mu.Lock()
-		dc.cache.Add(hostname, addrs)
+		dc.cache.Add(hostname, e)
 		dc.mu.Unlock()
 	}
 	return
@@ -0,0 +1,44 @@
+package ipfilter
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// countLookuper resolve every host to 192.0.2.1, and count lookups.
+type countLookuper struct {
+	n int
+}
+
+func (cl *countLookuper) LookupIP(host string) (addrs []net.IP, err error) {
+	cl.n++
+	return []net.IP{net.ParseIP("192.0.2.1")}, nil
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	cl := &countLookuper{}
+	dc := NewDNSCache(cl)
+	dc.LookupIP("example.com")
+	dc.LookupIP("example.com")
+	if cl.n != 1 {
+		t.Fatalf("cached host looked up again: %d", cl.n)
+	}
+
+	// entry never expire without TTL.
+	value, _ := dc.cache.Get("example.com")
+	value.(*cacheEntry).expire = time.Time{}
+	dc.LookupIP("example.com")
+	if cl.n != 1 {
+		t.Fatalf("entry without TTL expired")
+	}
+
+	dc.TTL = time.Minute
+	dc.LookupIP("example.org")
+	value, _ = dc.cache.Get("example.org")
+	value.(*cacheEntry).expire = time.Now().Add(-time.Second)
+	dc.LookupIP("example.org")
+	if cl.n != 3 {
+		t.Fatalf("expired entry not looked up again: %d", cl.n)
+	}
+}
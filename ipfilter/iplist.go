@@ -3,6 +3,7 @@ package ipfilter
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -194,9 +195,13 @@ func Getaddrs(lookuper sutils.Lookuper, hostname string) (ips []net.IP) {
 }
 
 func (fd *FilteredDialer) Dial(network, address string) (conn net.Conn, err error) {
+	return fd.DialContext(context.Background(), network, address)
+}
+
+func (fd *FilteredDialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
 	log.Infof("filter dial: %s", address)
 	if len(fd.fps) == 0 {
-		return fd.dialer.Dial(network, address)
+		return fd.dialer.DialContext(ctx, network, address)
 	}
 
 	hostname, _, err := net.SplitHostPort(address)
@@ -213,10 +218,10 @@ func (fd *FilteredDialer) Dial(network, address string) (conn net.Conn, err erro
 	for _, fp := range fd.fps {
 		for _, addr := range addrs {
 			if fp.filter.Contain(addr) {
-				return fp.dialer.Dial(network, address)
+				return fp.dialer.DialContext(ctx, network, address)
 			}
 		}
 	}
 
-	return fd.dialer.Dial(network, address)
+	return fd.dialer.DialContext(ctx, network, address)
 }
@@ -0,0 +1,387 @@
+package msocks
+
+import (
+	"bufio"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AccountRecord is traffic of one user to one destination host in one day.
+// Up is bytes from client to target, Down is the other way.
+type AccountRecord struct {
+	Day  string `json:"day,omitempty"`
+	User string `json:"user,omitempty"`
+	Host string `json:"host,omitempty"`
+	Up   int64  `json:"up"`
+	Down int64  `json:"down"`
+}
+
+type accountKey struct {
+	day, user, host string
+}
+
+// accountShard hold part of traffic pending, so data path of different
+// users and hosts don't wait for each other.
+type accountShard struct {
+	lock    sync.Mutex
+	pending map[accountKey]*AccountRecord
+}
+
+// Accounting collect traffic in memory, and append records into a json
+// lines file every ACCOUNT_INTERVAL seconds. Each line is traffic since
+// last flush, so records of the same key should be summed when read.
+// Once a day, the file is compacted to one line for each key.
+type Accounting struct {
+	shards [ACCOUNT_SHARDS]accountShard
+	// day is today, valid until dayend in unix seconds.
+	day    atomic.Value
+	dayend int64
+
+	// flock serialize file access, so data path will not wait for file.
+	flock sync.Mutex
+	path  string
+	file  *os.File
+	// size of file flushed, Query read no more than it.
+	size int64
+	// day of last compaction.
+	compacted string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewAccounting(path string) (a *Accounting, err error) {
+	a = &Accounting{
+		path: path,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	err = a.open()
+	if err != nil {
+		return nil, err
+	}
+	for i := range a.shards {
+		a.shards[i].pending = make(map[accountKey]*AccountRecord)
+	}
+	go a.flusher()
+	return
+}
+
+func (a *Accounting) open() (err error) {
+	a.file, err = os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	fi, err := a.file.Stat()
+	if err != nil {
+		a.file.Close()
+		return
+	}
+	a.size = fi.Size()
+	return
+}
+
+// today return day of now, formatted only when day changed.
+func (a *Accounting) today() string {
+	now := time.Now()
+	if now.Unix() < atomic.LoadInt64(&a.dayend) {
+		return a.day.Load().(string)
+	}
+	day := now.Format("2006-01-02")
+	y, m, d := now.Date()
+	a.day.Store(day)
+	atomic.StoreInt64(&a.dayend, time.Date(y, m, d+1, 0, 0, 0, 0, now.Location()).Unix())
+	return day
+}
+
+func (a *Accounting) shard(user, host string) *accountShard {
+	h := fnv.New32a()
+	h.Write([]byte(user))
+	h.Write([]byte(host))
+	return &a.shards[h.Sum32()%ACCOUNT_SHARDS]
+}
+
+// Add count traffic of user to address, address can be host or host:port.
+func (a *Accounting) Add(user, address string, up, down int) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	key := accountKey{a.today(), user, host}
+
+	sh := a.shard(user, host)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	r, ok := sh.pending[key]
+	if !ok {
+		r = &AccountRecord{Day: key.day, User: user, Host: host}
+		sh.pending[key] = r
+	}
+	r.Up += int64(up)
+	r.Down += int64(down)
+}
+
+// eachPending call fn with records pending, under lock of shards.
+func (a *Accounting) eachPending(fn func(*AccountRecord)) {
+	for i := range a.shards {
+		sh := &a.shards[i]
+		sh.lock.Lock()
+		for _, r := range sh.pending {
+			fn(r)
+		}
+		sh.lock.Unlock()
+	}
+}
+
+// takePending return records pending and clear them.
+func (a *Accounting) takePending() (pending []*AccountRecord) {
+	for i := range a.shards {
+		sh := &a.shards[i]
+		sh.lock.Lock()
+		m := sh.pending
+		sh.pending = make(map[accountKey]*AccountRecord)
+		sh.lock.Unlock()
+		for _, r := range m {
+			pending = append(pending, r)
+		}
+	}
+	return
+}
+
+func (a *Accounting) flusher() {
+	defer close(a.done)
+	for {
+		select {
+		case <-time.After(ACCOUNT_INTERVAL * time.Second):
+		case <-a.stop:
+			a.Flush()
+			return
+		}
+		a.Flush()
+	}
+}
+
+// Flush write records pending into file, compact it if not yet today.
+func (a *Accounting) Flush() (err error) {
+	a.flock.Lock()
+	defer a.flock.Unlock()
+
+	pending := a.takePending()
+	if today := a.today(); a.compacted != today {
+		err = a.compact(pending)
+		if err != nil {
+			log.Errorf("compact accounting failed: %s", err)
+		} else {
+			a.compacted = today
+			return
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	w := bufio.NewWriter(a.file)
+	err = writeRecords(w, pending)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Errorf("accounting records lost: %s", err)
+	}
+	if fi, e := a.file.Stat(); e == nil {
+		a.size = fi.Size()
+	}
+	return
+}
+
+func writeRecords(w io.Writer, records []*AccountRecord) (err error) {
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		err = enc.Encode(r)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// readRecords call fn for each record in rd.
+func readRecords(rd io.Reader, fn func(*AccountRecord)) error {
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		var r AccountRecord
+		// line may be broken if crashed when writing, skip it.
+		if json.Unmarshal(scanner.Bytes(), &r) != nil {
+			continue
+		}
+		fn(&r)
+	}
+	return scanner.Err()
+}
+
+// compact rewrite file with records summed by key, pending included.
+// New file replace the old one by rename, so it's never half written.
+// Called in flock.
+func (a *Accounting) compact(pending []*AccountRecord) (err error) {
+	sum := make(map[accountKey]*AccountRecord)
+	var records []*AccountRecord
+	add := func(r *AccountRecord) {
+		k := accountKey{r.Day, r.User, r.Host}
+		s, ok := sum[k]
+		if !ok {
+			s = &AccountRecord{Day: r.Day, User: r.User, Host: r.Host}
+			sum[k] = s
+			records = append(records, s)
+		}
+		s.Up += r.Up
+		s.Down += r.Down
+	}
+
+	file, err := os.Open(a.path)
+	if err != nil {
+		return
+	}
+	err = readRecords(file, add)
+	file.Close()
+	if err != nil {
+		return
+	}
+	for _, r := range pending {
+		add(r)
+	}
+
+	tmp := a.path + ".tmp"
+	file, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(file)
+	err = writeRecords(w, records)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmp, a.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	a.file.Close()
+	err = a.open()
+	if err != nil {
+		// records are in new file, but nothing can be written later.
+		log.Errorf("reopen accounting failed: %s", err)
+		return nil
+	}
+	log.Infof("accounting compacted, %d records.", len(records))
+	return
+}
+
+// Close flush records and close file.
+func (a *Accounting) Close() error {
+	close(a.stop)
+	<-a.done
+	return a.file.Close()
+}
+
+// AccountFilter select records in Query. Empty field matches all.
+// From and To are days like 2006-01-02, both included. By is fields
+// kept in result, in day, user and host. Records with the same kept
+// fields will be summed. Empty By keeps all.
+type AccountFilter struct {
+	User string
+	Host string
+	From string
+	To   string
+	By   []string
+}
+
+func (f *AccountFilter) match(r *AccountRecord) bool {
+	return (f.User == "" || r.User == f.User) &&
+		(f.Host == "" || r.Host == f.Host) &&
+		(f.From == "" || r.Day >= f.From) &&
+		(f.To == "" || r.Day <= f.To)
+}
+
+func (f *AccountFilter) key(r *AccountRecord) (k accountKey) {
+	if len(f.By) == 0 {
+		return accountKey{r.Day, r.User, r.Host}
+	}
+	for _, by := range f.By {
+		switch strings.ToLower(by) {
+		case "day":
+			k.day = r.Day
+		case "user":
+			k.user = r.User
+		case "host":
+			k.host = r.Host
+		}
+	}
+	return
+}
+
+// Query read records in file and memory, sum them by filter.
+func (a *Accounting) Query(f *AccountFilter) (records []*AccountRecord, err error) {
+	sum := make(map[accountKey]*AccountRecord)
+	add := func(r *AccountRecord) {
+		if !f.match(r) {
+			return
+		}
+		k := f.key(r)
+		s, ok := sum[k]
+		if !ok {
+			s = &AccountRecord{Day: k.day, User: k.user, Host: k.host}
+			sum[k] = s
+		}
+		s.Up += r.Up
+		s.Down += r.Down
+	}
+
+	// file flushed and pending are taken together, so a record is
+	// counted once. Flush and Add will not wait for file read.
+	a.flock.Lock()
+	file, err := os.Open(a.path)
+	if err != nil {
+		a.flock.Unlock()
+		return
+	}
+	defer file.Close()
+	size := a.size
+	a.eachPending(add)
+	a.flock.Unlock()
+
+	// file may be appended or replaced, but content read is the same.
+	err = readRecords(io.LimitReader(file, size), add)
+	if err != nil {
+		return
+	}
+
+	for _, r := range sum {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		ri, rj := records[i], records[j]
+		if ri.Day != rj.Day {
+			return ri.Day < rj.Day
+		}
+		if ri.User != rj.User {
+			return ri.User < rj.User
+		}
+		return ri.Host < rj.Host
+	})
+	return
+}
@@ -0,0 +1,197 @@
+package msocks
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/sutils"
+)
+
+func newTestAccounting(t *testing.T) (a *Accounting, path string) {
+	dir, err := ioutil.TempDir("", "account")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	path = filepath.Join(dir, "account.json")
+	a, err = NewAccounting(path)
+	if err != nil {
+		t.Fatalf("NewAccounting failed: %s", err)
+	}
+	return
+}
+
+func countLines(t *testing.T, path string) (n int) {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		n++
+	}
+	return
+}
+
+func TestAccountingFlush(t *testing.T) {
+	a, path := newTestAccounting(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	a.Add("alice", "example.com:443", 10, 100)
+	a.Add("alice", "example.com:80", 1, 2)
+	a.Add("bob", "example.org", 5, 0)
+	err := a.Flush()
+	if err != nil {
+		t.Fatalf("Flush failed: %s", err)
+	}
+	// ports of the same host counted together.
+	if n := countLines(t, path); n != 2 {
+		t.Fatalf("should write 2 records, got %d", n)
+	}
+	n := 0
+	a.eachPending(func(*AccountRecord) { n++ })
+	if n != 0 {
+		t.Fatalf("pending not cleared after flush")
+	}
+
+	// each flush append increment since last one.
+	a.Add("alice", "example.com:443", 10, 100)
+	a.Close()
+	if n := countLines(t, path); n != 3 {
+		t.Fatalf("close should flush pending, got %d lines", n)
+	}
+}
+
+func TestAccountingCompact(t *testing.T) {
+	a, path := newTestAccounting(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer a.Close()
+
+	a.Add("alice", "example.com:443", 10, 100)
+	a.Flush()
+	a.Add("alice", "example.com:443", 1, 1)
+	a.Flush()
+	if n := countLines(t, path); n != 2 {
+		t.Fatalf("flush in the same day should append, got %d lines", n)
+	}
+
+	// next day, file compacted to one line for each key.
+	a.compacted = ""
+	a.Add("alice", "example.com:443", 1, 1)
+	a.Add("bob", "example.com:443", 1, 1)
+	a.Flush()
+	if n := countLines(t, path); n != 2 {
+		t.Fatalf("file not compacted, got %d lines", n)
+	}
+	records, err := a.Query(&AccountFilter{User: "alice"})
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	if len(records) != 1 || records[0].Up != 12 || records[0].Down != 102 {
+		t.Fatalf("records wrong after compact: %+v", records)
+	}
+
+	// appended after compacted file reopened.
+	a.Add("alice", "example.com:443", 1, 1)
+	a.Flush()
+	if n := countLines(t, path); n != 3 {
+		t.Fatalf("flush after compact should append, got %d lines", n)
+	}
+}
+
+func TestAccountingQuery(t *testing.T) {
+	a, path := newTestAccounting(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer a.Close()
+	today := time.Now().Format("2006-01-02")
+
+	a.Add("alice", "example.com:443", 10, 100)
+	a.Add("bob", "example.com:443", 5, 50)
+	a.Flush()
+	// pending in memory counted too.
+	a.Add("alice", "example.com:443", 1, 1)
+	a.Add("alice", "example.org:443", 2, 2)
+
+	records, err := a.Query(&AccountFilter{User: "alice"})
+	if err != nil {
+		t.Fatalf("Query failed: %s", err)
+	}
+	if len(records) != 2 || records[0].Host != "example.com" ||
+		records[0].Up != 11 || records[0].Down != 101 || records[0].Day != today {
+		t.Fatalf("records of user wrong: %+v", records)
+	}
+
+	records, _ = a.Query(&AccountFilter{Host: "example.com", By: []string{"host"}})
+	if len(records) != 1 || records[0].User != "" || records[0].Up != 16 || records[0].Down != 151 {
+		t.Fatalf("records by host wrong: %+v", records)
+	}
+
+	records, _ = a.Query(&AccountFilter{By: []string{"user", "day"}})
+	if len(records) != 2 || records[0].User != "alice" || records[0].Up != 13 || records[1].Up != 5 {
+		t.Fatalf("records by user and day wrong: %+v", records)
+	}
+
+	records, _ = a.Query(&AccountFilter{From: "2000-01-01", To: "2000-12-31"})
+	if len(records) != 0 {
+		t.Fatalf("records out of date range: %+v", records)
+	}
+}
+
+func TestAccountingDatagram(t *testing.T) {
+	a, path := newTestAccounting(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer a.Close()
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	c1, c2 := net.Pipe()
+	client := NewMuxSession(c1, false)
+	server := NewMuxSession(c2, true)
+	server.server = &MsocksServer{Accounting: a}
+	server.dialer = sutils.DefaultTcpDialer
+	go client.Run()
+	go server.Run()
+	defer client.Close()
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(echo.LocalAddr().String())
+	dc, err := client.DialDatagram(net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("DialDatagram failed: %s", err)
+	}
+	defer dc.Close()
+	_, err = dc.Write([]byte("ping"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	buf := make([]byte, 16)
+	n, err := dc.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("echo failed: %q %v", buf[:n], err)
+	}
+
+	// both directions counted by destination requested.
+	records, _ := a.Query(&AccountFilter{})
+	if len(records) != 1 || records[0].Host != "localhost" || records[0].Up != 4 || records[0].Down != 4 {
+		t.Fatalf("datagram traffic wrong: %+v", records)
+	}
+}
@@ -0,0 +1,159 @@
+package msocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/shell909090/goproxy/sutils"
+)
+
+// ACL is destination policy of one user in server.
+// Network limit network types, like tcp or udp, empty for all.
+// Ports limit ports, like "80,443,8000-9000", empty for all.
+// Rules in Deny and Allow are in format of sutils.MatchHostRule,
+// checked against both domain and ips resolved.
+// Deny first, then if Allow not empty, destination must match one of it.
+type ACL struct {
+	Network []string
+	Ports   string
+	Allow   []string
+	Deny    []string
+	ports   []PortRange
+}
+
+// SetACL set acls by username, "*" for users not listed.
+func (ms *MsocksServer) SetACL(acls map[string]*ACL) (err error) {
+	for username, acl := range acls {
+		acl.ports, err = ParsePortRanges(acl.Ports)
+		if err != nil {
+			return fmt.Errorf("acl of %s: %s", username, err)
+		}
+	}
+	ms.acls = acls
+	return
+}
+
+func (ms *MsocksServer) getACL(username string) (acl *ACL) {
+	acl, ok := ms.acls[username]
+	if !ok {
+		acl = ms.acls["*"]
+	}
+	return
+}
+
+func (acl *ACL) matchAny(rules []string, host, port string, ips []net.IP) bool {
+	for _, rule := range rules {
+		if sutils.MatchHostRule(rule, host, port) {
+			return true
+		}
+		for _, ip := range ips {
+			if sutils.MatchHostRule(rule, ip.String(), port) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check return reason if denied.
+func (acl *ACL) check(network, host, port string, ips []net.IP) string {
+	if len(acl.Network) > 0 {
+		ok := false
+		for _, n := range acl.Network {
+			ok = ok || strings.HasPrefix(network, n)
+		}
+		if !ok {
+			return "network not allowed"
+		}
+	}
+
+	if len(acl.ports) > 0 {
+		p, _ := strconv.Atoi(port)
+		ok := false
+		for _, pr := range acl.ports {
+			ok = ok || (pr.Min <= p && p <= pr.Max)
+		}
+		if !ok {
+			return "port not allowed"
+		}
+	}
+
+	if acl.matchAny(acl.Deny, host, port, ips) {
+		return "denied by rule"
+	}
+
+	if len(acl.Allow) > 0 && !acl.matchAllow(host, port, ips) {
+		return "not in allow list"
+	}
+	return ""
+}
+
+// matchAllow pass if domain allowed, or all ips allowed.
+func (acl *ACL) matchAllow(host, port string, ips []net.IP) bool {
+	for _, rule := range acl.Allow {
+		if sutils.MatchHostRule(rule, host, port) {
+			return true
+		}
+	}
+	if len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !acl.matchAny(acl.Allow, ip.String(), port, nil) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckACL check destination of user after resolved. Return addresses
+// with all ips resolved, in order, so dialer will not resolve it again to
+// another ip. Address returned as it is if no acl for user.
+func (ms *MsocksServer) CheckACL(ctx context.Context, username, network, address string) (resolved []string, err error) {
+	if ms == nil {
+		return []string{address}, nil
+	}
+	acl := ms.getACL(username)
+	if acl == nil {
+		return []string{address}, nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		// same resolver as dns queries, so policy there applies.
+		r := ms.Resolver
+		if r == nil {
+			r = defaultResolver
+		}
+		ips, err = r.LookupIP(ctx, host)
+		if err != nil {
+			return
+		}
+	}
+
+	reason := acl.check(network, host, port, ips)
+	if reason != "" {
+		log.Warningf("audit: user %s denied %s:%s %v, %s.", username, network, address, ips, reason)
+		return nil, &DialError{
+			Errno:   ERR_FORBIDDEN,
+			Msg:     reason,
+			Network: network,
+			Address: address,
+		}
+	}
+	// all ips allowed if passed.
+	for _, ip := range ips {
+		resolved = append(resolved, net.JoinHostPort(ip.String(), port))
+	}
+	return
+}
@@ -0,0 +1,135 @@
+package msocks
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/shell909090/goproxy/sutils"
+)
+
+func TestACLCheck(t *testing.T) {
+	ms := &MsocksServer{}
+	err := ms.SetACL(map[string]*ACL{
+		"*": {
+			Network: []string{"tcp"},
+			Ports:   "80,443",
+			Allow:   []string{"*.example.com", "10.0.0.0/8"},
+			Deny:    []string{"bad.example.com", "10.1.0.0/16", "::1", "[2001:db8::1]:443"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("SetACL failed: %s", err)
+	}
+	acl := ms.getACL("user")
+
+	ip := func(s ...string) (ips []net.IP) {
+		for _, a := range s {
+			ips = append(ips, net.ParseIP(a))
+		}
+		return
+	}
+	for _, tc := range []struct {
+		network, host, port string
+		ips                 []net.IP
+		denied              bool
+	}{
+		{"tcp", "www.example.com", "443", ip("192.0.2.1"), false},
+		{"tcp", "example.org", "443", ip("10.0.0.1", "10.2.0.1"), false},
+		{"tcp", "example.org", "443", ip("10.0.0.1", "192.0.2.1"), true},
+		{"tcp", "bad.example.com", "443", ip("192.0.2.1"), true},
+		{"tcp", "BAD.example.com", "443", ip("192.0.2.1"), true},
+		{"tcp", "bad.example.com.", "443", ip("192.0.2.1"), true},
+		{"tcp", "www.Example.COM.", "443", ip("192.0.2.1"), false},
+		{"tcp", "www.example.com", "443", ip("::1"), true},
+		{"tcp", "::1", "80", ip("::1"), true},
+		{"tcp", "www.example.com", "443", ip("2001:db8::1"), true},
+		{"tcp", "www.example.com", "80", ip("2001:db8::1"), false},
+		{"tcp", "www.example.com", "443", ip("10.1.0.1"), true},
+		{"tcp", "www.example.com", "22", ip("192.0.2.1"), true},
+		{"udp", "www.example.com", "443", ip("192.0.2.1"), true},
+	} {
+		reason := acl.check(tc.network, tc.host, tc.port, tc.ips)
+		if (reason != "") != tc.denied {
+			t.Fatalf("check %s %s:%s %v, got %q", tc.network, tc.host, tc.port, tc.ips, reason)
+		}
+	}
+}
+
+func TestCheckACLResolved(t *testing.T) {
+	ms := &MsocksServer{Resolver: NewResolver()}
+	cacheAddr(ms.Resolver, "localhost", "127.0.0.1", "::1")
+	ms.SetACL(map[string]*ACL{
+		"user": {Deny: []string{"192.0.2.0/24"}},
+	})
+
+	addrs, err := ms.CheckACL(context.Background(), "other", "tcp", "localhost:80")
+	if err != nil || len(addrs) != 1 || addrs[0] != "localhost:80" {
+		t.Fatalf("address should be kept without acl, got %v %v", addrs, err)
+	}
+
+	addrs, err = ms.CheckACL(context.Background(), "user", "tcp", "localhost:80")
+	if err != nil || len(addrs) == 0 {
+		t.Fatalf("CheckACL failed: %v %s", addrs, err)
+	}
+	for _, addr := range addrs {
+		host, _, _ := net.SplitHostPort(addr)
+		if net.ParseIP(host) == nil {
+			t.Fatalf("address not resolved: %s", addr)
+		}
+	}
+
+	if len(addrs) != 2 || addrs[0] != "127.0.0.1:80" || addrs[1] != "[::1]:80" {
+		t.Fatalf("addresses should be ipv4 first: %v", addrs)
+	}
+
+	_, err = ms.CheckACL(context.Background(), "user", "tcp", "192.0.2.1:80")
+	if de, ok := err.(*DialError); !ok || de.Errno != ERR_FORBIDDEN {
+		t.Fatalf("denied address should be forbidden, got %v", err)
+	}
+
+	// resolved by server resolver, dns policy applies.
+	ms.Resolver.Blocked = []string{"localhost"}
+	_, err = ms.CheckACL(context.Background(), "user", "tcp", "localhost:80")
+	if de, ok := err.(*net.DNSError); !ok || !de.IsNotFound {
+		t.Fatalf("blocked domain should not be resolved, got %v", err)
+	}
+}
+
+func TestSynTargetUpstream(t *testing.T) {
+	ms := &MsocksServer{Resolver: NewResolver()}
+	cacheAddr(ms.Resolver, "localhost", "127.0.0.1")
+	ms.SetACL(map[string]*ACL{
+		"*": {Deny: []string{"192.0.2.0/24"}},
+	})
+	upstream := CreateSessionPool(0, 0)
+	s := &Session{
+		server: ms,
+		dialer: &sutils.RuleDialer{
+			Rules:   []string{"localhost:80"},
+			Matched: upstream,
+			Default: sutils.DefaultTcpDialer,
+		},
+	}
+
+	c := NewConn(ST_SYN_RECV, 1, s, "tcp", "localhost:80")
+	c.ctx = context.Background()
+	dialer, _, addrs, err := s.synTarget(c)
+	if err != nil || dialer != upstream || len(addrs) != 1 || addrs[0] != "localhost:80" {
+		t.Fatalf("upstream should get domain, got %v %v", addrs, err)
+	}
+
+	// not upstream, dial ips checked, never resolve again.
+	c = NewConn(ST_SYN_RECV, 1, s, "tcp", "localhost:81")
+	c.ctx = context.Background()
+	dialer, _, addrs, err = s.synTarget(c)
+	if err != nil || dialer != sutils.DefaultTcpDialer || len(addrs) == 0 {
+		t.Fatalf("synTarget failed: %v %v", addrs, err)
+	}
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, "localhost") {
+			t.Fatalf("direct target should be resolved: %s", addr)
+		}
+	}
+}
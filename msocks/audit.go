@@ -0,0 +1,310 @@
+package msocks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AuditRecord is one stream finished in server, one syn refused, or one
+// destination of udp flow closed. Up is bytes from client to target,
+// Down is the other way.
+type AuditRecord struct {
+	User    string    `json:"user"`
+	Client  string    `json:"client"`
+	Network string    `json:"network"`
+	Dst     string    `json:"dst"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Up      int64     `json:"up"`
+	Down    int64     `json:"down"`
+	Reason  string    `json:"reason"`
+}
+
+// AuditLog write one json line for each stream into its own file.
+// File will be rotated when larger than MaxSize, at most MaxFiles old
+// files kept, as path.1, path.2 and so on. If HashKey set, host of
+// destination will be replaced by hmac of it, port kept.
+// Records are queued in memory when file is slow, and retried, with file
+// reopened, if write failed. At most AUDIT_QUEUE records queued, more are
+// dropped and counted, the count is logged when file can be written.
+type AuditLog struct {
+	MaxSize  int64
+	MaxFiles int
+	HashKey  string
+
+	path string
+	file *os.File
+	size int64
+
+	lock    sync.Mutex
+	closed  bool
+	ch      chan *AuditRecord
+	dropped int64
+	done    chan struct{}
+}
+
+func NewAuditLog(path string) (al *AuditLog, err error) {
+	al = &AuditLog{
+		MaxSize:  AUDIT_MAXSIZE,
+		MaxFiles: AUDIT_MAXFILES,
+		path:     path,
+		ch:       make(chan *AuditRecord, AUDIT_QUEUE),
+		done:     make(chan struct{}),
+	}
+	err = al.open()
+	if err != nil {
+		return nil, err
+	}
+	go al.writer()
+	return
+}
+
+func (al *AuditLog) open() (err error) {
+	file, err := os.OpenFile(al.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return
+	}
+	al.file, al.size = file, fi.Size()
+	return
+}
+
+func (al *AuditLog) rotate() (err error) {
+	al.file.Close()
+	al.file = nil
+	for i := al.MaxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", al.path, i), fmt.Sprintf("%s.%d", al.path, i+1))
+	}
+	if al.MaxFiles > 0 {
+		err = os.Rename(al.path, al.path+".1")
+	} else {
+		err = os.Remove(al.path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	return al.open()
+}
+
+// write b into file, reopen file if closed by error before.
+func (al *AuditLog) write(b []byte) (err error) {
+	if al.file == nil {
+		err = al.open()
+		if err != nil {
+			return
+		}
+	}
+	if al.MaxSize > 0 && al.size > 0 && al.size+int64(len(b)) > al.MaxSize {
+		err = al.rotate()
+		if err != nil {
+			return
+		}
+	}
+
+	n, err := al.file.Write(b)
+	al.size += int64(n)
+	if err != nil {
+		al.file.Close()
+		al.file = nil
+	}
+	return
+}
+
+func (al *AuditLog) isClosed() bool {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	return al.closed
+}
+
+// writer is the only one touch file, so session loop never wait for disk.
+func (al *AuditLog) writer() {
+	defer close(al.done)
+	for r := range al.ch {
+		b, err := json.Marshal(r)
+		if err != nil {
+			log.Errorf("%s", err)
+			continue
+		}
+		b = append(b, '\n')
+
+		// retry until written. after closed, give up in a few times,
+		// so shutdown will not hang.
+		for i := 0; ; i++ {
+			err = al.write(b)
+			if err == nil {
+				break
+			}
+			if al.isClosed() && i >= AUDIT_CLOSE_RETRIES {
+				log.Errorf("audit log write failed: %s, record of %s to %s dropped.", err, r.User, r.Dst)
+				break
+			}
+			log.Errorf("audit log write failed: %s, retry.", err)
+			time.Sleep(AUDIT_RETRY * time.Second)
+		}
+		al.logDropped()
+	}
+	al.logDropped()
+	if al.file != nil {
+		al.file.Close()
+	}
+}
+
+func (al *AuditLog) hash(address string) string {
+	if al.HashKey == "" {
+		return address
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, ""
+	}
+	mac := hmac.New(sha256.New, []byte(al.HashKey))
+	mac.Write([]byte(host))
+	host = hex.EncodeToString(mac.Sum(nil)[:16])
+	if port == "" {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Add queue a record, never block. Record after closed is logged, not
+// written. Record over AUDIT_QUEUE is dropped and counted.
+func (al *AuditLog) Add(r *AuditRecord) {
+	r.Dst = al.hash(r.Dst)
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if al.closed {
+		log.Errorf("audit closed, record of %s to %s dropped.", r.User, r.Dst)
+		return
+	}
+	select {
+	case al.ch <- r:
+	default:
+		atomic.AddInt64(&al.dropped, 1)
+	}
+}
+
+func (al *AuditLog) logDropped() {
+	if n := atomic.SwapInt64(&al.dropped, 0); n > 0 {
+		log.Errorf("audit queue full, %d records dropped.", n)
+	}
+}
+
+// GetDropped return records dropped and not logged yet.
+func (al *AuditLog) GetDropped() int64 {
+	return atomic.LoadInt64(&al.dropped)
+}
+
+// Close write all records queued and close file.
+func (al *AuditLog) Close() error {
+	al.lock.Lock()
+	if !al.closed {
+		al.closed = true
+		close(al.ch)
+	}
+	al.lock.Unlock()
+	<-al.done
+	return nil
+}
+
+// audit emit record of stream once, if audit log enabled in server.
+func (c *Conn) audit(reason string) {
+	if c.sess.server == nil || c.sess.server.Audit == nil {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&c.audited, 0, 1) {
+		return
+	}
+	c.sess.server.Audit.Add(&AuditRecord{
+		User:    c.sess.Username,
+		Client:  c.sess.RemoteAddr().String(),
+		Network: c.Network,
+		Dst:     c.Address,
+		Start:   c.start,
+		End:     time.Now(),
+		Up:      atomic.LoadInt64(&c.recved),
+		Down:    atomic.LoadInt64(&c.sent),
+		Reason:  reason,
+	})
+}
+
+// auditRefused emit record of syn refused before stream created, or udp
+// destination refused.
+func (s *Session) auditRefused(network, address, reason string) {
+	if s.server == nil || s.server.Audit == nil {
+		return
+	}
+	now := time.Now()
+	s.server.Audit.Add(&AuditRecord{
+		User:    s.Username,
+		Client:  s.RemoteAddr().String(),
+		Network: network,
+		Dst:     address,
+		Start:   now,
+		End:     now,
+		Reason:  reason,
+	})
+}
+
+// natStat is traffic of udp flow to one destination, for audit.
+type natStat struct {
+	start    time.Time
+	up, down int64
+}
+
+// count traffic of destination requested, if audit log enabled.
+// Stats more than UDP_NAT_MAX are emitted and cleared.
+func (ne *natEntry) count(dst string, up bool, n int) {
+	if ne.sess.server == nil || ne.sess.server.Audit == nil {
+		return
+	}
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+	st, ok := ne.stats[dst]
+	if !ok {
+		if len(ne.stats) >= UDP_NAT_MAX {
+			ne.audit("too many destinations")
+		}
+		st = &natStat{start: time.Now()}
+		ne.stats[dst] = st
+	}
+	if up {
+		st.up += int64(n)
+	} else {
+		st.down += int64(n)
+	}
+}
+
+// audit emit records of all destinations, and clear them. Called in
+// ne.lock.
+func (ne *natEntry) audit(reason string) {
+	if ne.sess.server == nil || ne.sess.server.Audit == nil {
+		return
+	}
+	now := time.Now()
+	for dst, st := range ne.stats {
+		ne.sess.server.Audit.Add(&AuditRecord{
+			User:    ne.sess.Username,
+			Client:  ne.sess.RemoteAddr().String(),
+			Network: "udp",
+			Dst:     dst,
+			Start:   st.start,
+			End:     now,
+			Up:      st.up,
+			Down:    st.down,
+			Reason:  reason,
+		})
+	}
+	ne.stats = make(map[string]*natStat)
+}
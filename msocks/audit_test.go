@@ -0,0 +1,271 @@
+package msocks
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/sutils"
+)
+
+func newTestAudit(t *testing.T) (al *AuditLog, path string) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	path = filepath.Join(dir, "audit.json")
+	al, err = NewAuditLog(path)
+	if err != nil {
+		t.Fatalf("NewAuditLog failed: %s", err)
+	}
+	return
+}
+
+func readAudit(t *testing.T, path string) (records []*AuditRecord) {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r AuditRecord
+		err = json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			t.Fatalf("broken record %q: %s", scanner.Text(), err)
+		}
+		records = append(records, &r)
+	}
+	return
+}
+
+func TestAuditHash(t *testing.T) {
+	al := &AuditLog{}
+	if h := al.hash("example.com:443"); h != "example.com:443" {
+		t.Fatalf("address should be kept without key, got %s", h)
+	}
+
+	al.HashKey = "secret"
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("example.com"))
+	expected := hex.EncodeToString(mac.Sum(nil)[:16])
+
+	if h := al.hash("example.com:443"); h != expected+":443" {
+		t.Fatalf("hash wrong, got %s", h)
+	}
+	if h := al.hash("example.com:80"); h != expected+":80" {
+		t.Fatalf("same host should get same hash, got %s", h)
+	}
+	if h := al.hash("example.com"); h != expected {
+		t.Fatalf("hash without port wrong, got %s", h)
+	}
+	if h := al.hash("[::1]:53"); strings.Contains(h, "::1") || !strings.HasSuffix(h, ":53") {
+		t.Fatalf("hash of ipv6 wrong, got %s", h)
+	}
+}
+
+func TestAuditStream(t *testing.T) {
+	al, path := newTestAudit(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	c1, c2 := net.Pipe()
+	client := NewMuxSession(c1, false)
+	server := NewMuxSession(c2, true)
+	server.server = &MsocksServer{Audit: al}
+	server.Username = "alice"
+	go client.Run()
+	go server.Run()
+	defer client.Close()
+	defer server.Close()
+
+	start := time.Now()
+	c, err := client.Open()
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	sc, err := server.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+	c.Write([]byte("hello"))
+	io.ReadFull(sc, make([]byte, 5))
+	sc.Write([]byte("hi"))
+	io.ReadFull(c, make([]byte, 2))
+	c.Close()
+	sc.Close()
+	if !waitSize(server, 0) {
+		t.Fatalf("stream not closed")
+	}
+	al.Close()
+
+	records := readAudit(t, path)
+	if len(records) != 1 {
+		t.Fatalf("should write one record, got %d", len(records))
+	}
+	r := records[0]
+	if r.User != "alice" || r.Client != c2.RemoteAddr().String() || r.Up != 5 || r.Down != 2 || r.Reason == "" {
+		t.Fatalf("record wrong: %+v", r)
+	}
+	if r.Start.Before(start.Add(-time.Second)) || r.End.Before(r.Start) {
+		t.Fatalf("time of record wrong: %+v", r)
+	}
+}
+
+func TestAuditRotate(t *testing.T) {
+	al, path := newTestAudit(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	al.MaxSize = 300
+	al.MaxFiles = 2
+
+	for i := 0; i < 10; i++ {
+		al.Add(&AuditRecord{User: fmt.Sprintf("user%d", i), Dst: "example.com:443"})
+	}
+	al.Close()
+
+	records := readAudit(t, path)
+	if len(records) == 0 || records[len(records)-1].User != "user9" {
+		t.Fatalf("last record should be in current file: %+v", records)
+	}
+	for _, p := range []string{path + ".1", path + ".2"} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("old file not kept: %s", err)
+		}
+		if fi.Size() > al.MaxSize {
+			t.Fatalf("file larger than MaxSize: %d", fi.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("more than MaxFiles old files kept")
+	}
+}
+
+func TestAuditRetry(t *testing.T) {
+	al, path := newTestAudit(t)
+	dir := filepath.Dir(path)
+	defer os.RemoveAll(dir)
+	al.MaxSize = 1
+
+	al.Add(&AuditRecord{User: "first"})
+	// rotate of next record will fail.
+	time.Sleep(100 * time.Millisecond)
+	os.RemoveAll(dir)
+	al.Add(&AuditRecord{User: "second"})
+	time.Sleep(100 * time.Millisecond)
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		t.Fatalf("MkdirAll failed: %s", err)
+	}
+	al.Add(&AuditRecord{User: "third"})
+	al.Close()
+
+	// each record rotated to its own file.
+	records := append(readAudit(t, path+".1"), readAudit(t, path)...)
+	if len(records) != 2 || records[0].User != "second" || records[1].User != "third" {
+		t.Fatalf("records should be written after file recovered: %+v", records)
+	}
+}
+
+func TestAuditQueueFull(t *testing.T) {
+	// no writer, queue never drained.
+	al := &AuditLog{ch: make(chan *AuditRecord, 2)}
+	for i := 0; i < 5; i++ {
+		al.Add(&AuditRecord{User: fmt.Sprintf("user%d", i)})
+	}
+	if len(al.ch) != 2 || al.GetDropped() != 3 {
+		t.Fatalf("queue not bounded: %d queued, %d dropped", len(al.ch), al.GetDropped())
+	}
+}
+
+func TestAuditRefused(t *testing.T) {
+	al, path := newTestAudit(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	c1, c2 := net.Pipe()
+	client := NewMuxSession(c1, false)
+	server := NewMuxSession(c2, true)
+	server.server = &MsocksServer{Audit: al}
+	server.Username = "alice"
+	go client.Run()
+	go server.Run()
+	defer client.Close()
+	defer server.Close()
+
+	server.Drain()
+	_, err := client.Dial("tcp", "example.com:80")
+	if err == nil {
+		t.Fatalf("dial to draining session should fail")
+	}
+	al.Close()
+
+	records := readAudit(t, path)
+	if len(records) != 1 || records[0].User != "alice" || records[0].Dst != "example.com:80" ||
+		records[0].Reason != "shutting down" {
+		t.Fatalf("refused syn not audited: %+v", records)
+	}
+}
+
+func TestAuditDatagram(t *testing.T) {
+	al, path := newTestAudit(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	c1, c2 := net.Pipe()
+	client := NewMuxSession(c1, false)
+	server := NewMuxSession(c2, true)
+	server.server = &MsocksServer{Audit: al, Resolver: NewResolver()}
+	server.dialer = sutils.DefaultTcpDialer
+	server.Username = "alice"
+	go client.Run()
+	go server.Run()
+	defer client.Close()
+
+	dc, err := client.DialDatagram(echo.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("DialDatagram failed: %s", err)
+	}
+	dc.Write([]byte("ping"))
+	n, err := dc.Read(make([]byte, 16))
+	if err != nil || n != 4 {
+		t.Fatalf("echo failed: %d %v", n, err)
+	}
+	server.Close()
+	al.Close()
+
+	records := readAudit(t, path)
+	if len(records) != 1 {
+		t.Fatalf("should write one record for udp flow, got %d", len(records))
+	}
+	r := records[0]
+	if r.Network != "udp" || r.Dst != echo.LocalAddr().String() || r.Up != 4 || r.Down != 4 ||
+		r.Reason != "session closed" {
+		t.Fatalf("record of udp flow wrong: %+v", r)
+	}
+}
@@ -0,0 +1,357 @@
+package msocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shell909090/goproxy/sutils"
+)
+
+// ---- server side ----
+
+// Binding is a listener in server, opened by FrameBind from client.
+type Binding struct {
+	lock     sync.Mutex
+	closed   bool
+	sess     *Session
+	streamid uint16
+	Network  string
+	Address  string
+	listener net.Listener
+}
+
+func (s *Session) on_bind(ft *FrameBind) (err error) {
+	errno, msg := uint32(ERR_NONE), ""
+	b := &Binding{
+		sess:     s,
+		streamid: ft.Streamid,
+		Network:  ft.Network,
+		Address:  ft.Address,
+	}
+
+	err = s.server.CheckBind(s.Username, ft.Network, ft.Address)
+	if err != nil {
+		errno, msg = ERR_DENIED, err.Error()
+	} else {
+		b.listener, err = net.Listen(ft.Network, ft.Address)
+		if err != nil {
+			errno = ErrnoFromError(err)
+		}
+	}
+
+	if err == nil {
+		err = s.PutIntoId(ft.Streamid, b)
+		if err != nil {
+			b.listener.Close()
+			errno, msg = ERR_IDEXIST, ""
+		}
+	}
+
+	if err != nil {
+		log.Errorf("%s bind %s:%s failed: %s", s.String(), ft.Network, ft.Address, err)
+		fb := s.resultFrame(ft.Streamid, errno, msg)
+		return s.SendFrame(fb)
+	}
+
+	fb := NewFrameResult(ft.Streamid, ERR_NONE)
+	err = s.SendFrame(fb)
+	if err != nil {
+		return
+	}
+
+	log.Noticef("%s bind %s:%s for %s.", s.String(), ft.Network, ft.Address, s.Username)
+	go b.serve()
+	return
+}
+
+func (b *Binding) String() string {
+	return fmt.Sprintf("%d(%d)", b.sess.LocalPort(), b.streamid)
+}
+
+func (b *Binding) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			log.Errorf("%s", err)
+			break
+		}
+		go b.handle(conn)
+	}
+
+	if b.close() {
+		// closed by listener error, not by client.
+		b.sess.RemovePort(b.streamid)
+		b.sess.SendFrame(NewFrameRst(b.streamid))
+	}
+}
+
+func (b *Binding) handle(conn net.Conn) {
+	log.Infof("%s accept %s.", b.String(), conn.RemoteAddr())
+	c := NewConn(ST_SYN_SENT, 0, b.sess, b.Network, b.Address)
+	streamid, err := b.sess.PutIntoNextId(c)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	c.streamid = streamid
+
+	err = c.WaitForConn(context.Background())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	sutils.CopyLink(conn, c)
+}
+
+// return true if it is closed in this call.
+func (b *Binding) close() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return false
+	}
+	b.closed = true
+	b.listener.Close()
+	log.Noticef("%s unbind %s:%s.", b.String(), b.Network, b.Address)
+	return true
+}
+
+func (b *Binding) SendFrame(f Frame) (err error) {
+	switch f.(type) {
+	case *FrameFin, *FrameRst:
+		if b.close() {
+			b.sess.RemovePort(b.streamid)
+		}
+	default:
+		log.Errorf("%s unexpected %s", b.String(), f.Debug())
+	}
+	return
+}
+
+func (b *Binding) CloseFrame() error {
+	b.close()
+	return nil
+}
+
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// ParsePortRanges parse string like "2222,10000-10100".
+func ParsePortRanges(s string) (prs []PortRange, err error) {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var pr PortRange
+		bounds := strings.SplitN(part, "-", 2)
+		pr.Min, err = strconv.Atoi(bounds[0])
+		if err != nil {
+			return
+		}
+		pr.Max = pr.Min
+		if len(bounds) == 2 {
+			pr.Max, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return
+			}
+		}
+		prs = append(prs, pr)
+	}
+	return
+}
+
+func (ms *MsocksServer) SetBindPorts(bindports map[string]string) (err error) {
+	ms.bindports = make(map[string][]PortRange, 0)
+	for username, s := range bindports {
+		ms.bindports[username], err = ParsePortRanges(s)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (ms *MsocksServer) CheckBind(username, network, address string) (err error) {
+	if ms == nil {
+		return ErrBindDenied
+	}
+	if !strings.HasPrefix(network, "tcp") {
+		return ErrBindDenied
+	}
+
+	_, sport, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(sport)
+	if err != nil {
+		return
+	}
+
+	for _, pr := range ms.bindports[username] {
+		if pr.Min <= port && port <= pr.Max {
+			return nil
+		}
+	}
+	return ErrBindDenied
+}
+
+// ---- client side ----
+
+// ClientBind is a bind registered in one session of client.
+type ClientBind struct {
+	sess     *Session
+	streamid uint16
+	Network  string
+	Address  string
+	Target   string
+	dialer   sutils.Dialer
+	inport   bool
+	ch       chan *FrameResult
+	once     sync.Once
+	done     chan struct{}
+}
+
+// Bind ask remote to listen at address. Connections accepted by remote
+// will be connected to target locally, by dialer.
+func (s *Session) Bind(network, address, target string, dialer sutils.Dialer) (cb *ClientBind, err error) {
+	cb = &ClientBind{
+		sess:    s,
+		Network: network,
+		Address: address,
+		Target:  target,
+		dialer:  dialer,
+		ch:      make(chan *FrameResult, 1),
+		done:    make(chan struct{}),
+	}
+
+	s.dlock.Lock()
+	if _, ok := s.binds[address]; ok {
+		s.dlock.Unlock()
+		return nil, ErrIdExist
+	}
+	s.binds[address] = cb
+	s.dlock.Unlock()
+
+	cb.streamid, err = s.PutIntoNextId(cb)
+	if err != nil {
+		cb.remove()
+		return nil, err
+	}
+	cb.inport = true
+
+	err = s.SendFrame(NewFrameBind(cb.streamid, network, address))
+	if err != nil {
+		cb.remove()
+		return nil, err
+	}
+
+	select {
+	case ft := <-cb.ch:
+		if ft.Errno != ERR_NONE {
+			err = &DialError{
+				Errno:   ft.Errno,
+				Msg:     ft.Message,
+				Network: network,
+				Address: address,
+			}
+		}
+	case <-cb.done:
+		err = ErrStreamReset
+	case <-time.After(DIAL_TIMEOUT * time.Second):
+		err = ErrBindTimeout
+	}
+
+	if err != nil {
+		log.Errorf("%s bind %s failed: %s", s.String(), address, err)
+		cb.remove()
+		return nil, err
+	}
+	log.Noticef("%s remote bind %s => %s.", s.String(), address, target)
+	return
+}
+
+func (cb *ClientBind) remove() {
+	cb.sess.dlock.Lock()
+	if cb.sess.binds[cb.Address] == cb {
+		delete(cb.sess.binds, cb.Address)
+	}
+	cb.sess.dlock.Unlock()
+
+	if cb.inport {
+		cb.inport = false
+		cb.sess.RemovePort(cb.streamid)
+	}
+	cb.CloseFrame()
+}
+
+// Done will be closed when bind removed by remote or session closed.
+func (cb *ClientBind) Done() <-chan struct{} {
+	return cb.done
+}
+
+func (cb *ClientBind) Close() (err error) {
+	err = cb.sess.SendFrame(NewFrameFin(cb.streamid))
+	cb.remove()
+	return
+}
+
+func (cb *ClientBind) SendFrame(f Frame) (err error) {
+	switch ft := f.(type) {
+	case *FrameResult:
+		select {
+		case cb.ch <- ft:
+		default:
+		}
+	case *FrameFin, *FrameRst:
+		log.Noticef("%s remote unbind %s.", cb.sess.String(), cb.Address)
+		cb.remove()
+	default:
+		log.Errorf("unexpected %s", f.Debug())
+	}
+	return
+}
+
+func (cb *ClientBind) CloseFrame() error {
+	cb.once.Do(func() {
+		close(cb.done)
+	})
+	return nil
+}
+
+// unbindAll remove all binds in session, both server and client side.
+func (s *Session) unbindAll() {
+	s.plock.Lock()
+	var fss []FrameSender
+	for _, fs := range s.ports {
+		fss = append(fss, fs)
+	}
+	s.plock.Unlock()
+
+	for _, fs := range fss {
+		switch b := fs.(type) {
+		case *Binding:
+			if b.close() {
+				s.RemovePort(b.streamid)
+				s.SendFrame(NewFrameRst(b.streamid))
+			}
+		case *ClientBind:
+			b.Close()
+		}
+	}
+}
+
+func (s *Session) getBind(address string) (cb *ClientBind) {
+	s.dlock.Lock()
+	defer s.dlock.Unlock()
+	return s.binds[address]
+}
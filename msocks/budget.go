@@ -0,0 +1,56 @@
+package msocks
+
+import (
+	"sync/atomic"
+)
+
+// MemBudget counts bytes buffered but not yet read by application.
+// Each charge also goes to parent, so a session budget can share
+// one global limit with other sessions in the same pool.
+type MemBudget struct {
+	parent *MemBudget
+	Limit  int64
+	used   int64
+}
+
+func NewMemBudget(limit int64, parent *MemBudget) (mb *MemBudget) {
+	return &MemBudget{
+		parent: parent,
+		Limit:  limit,
+	}
+}
+
+// Acquire charge n bytes. If any limit in chain exceeded, nothing will be
+// charged and false returned. Limit 0 means no limit.
+func (mb *MemBudget) Acquire(n int64) bool {
+	if mb == nil {
+		return true
+	}
+
+	used := atomic.AddInt64(&mb.used, n)
+	if mb.Limit != 0 && used > mb.Limit {
+		atomic.AddInt64(&mb.used, -n)
+		return false
+	}
+
+	if !mb.parent.Acquire(n) {
+		atomic.AddInt64(&mb.used, -n)
+		return false
+	}
+	return true
+}
+
+func (mb *MemBudget) Release(n int64) {
+	if mb == nil {
+		return
+	}
+	atomic.AddInt64(&mb.used, -n)
+	mb.parent.Release(n)
+}
+
+func (mb *MemBudget) GetUsed() int64 {
+	if mb == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&mb.used)
+}
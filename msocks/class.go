@@ -0,0 +1,94 @@
+package msocks
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/shell909090/goproxy/sutils"
+)
+
+// Streams are classified as interactive or bulk when dial. Bulk streams go
+// to their own sessions, so big downloads will not delay interactive ones.
+// A destination is bulk if it matches bulk rules, or one stream to this
+// host received more than BulkThreshold bytes in last BULK_MEMORY seconds.
+
+func (sf *SessionFactory) serve(class string) bool {
+	return sf.Class == "" || sf.Class == class
+}
+
+// SetBulkRules set destinations always treated as bulk.
+// See sutils.MatchHostRule for format of rules.
+func (sp *SessionPool) SetBulkRules(rules []string) {
+	sp.bulkrules = rules
+}
+
+func (sp *SessionPool) classify(address string) string {
+	if len(sp.bulkrules) == 0 && sp.BulkThreshold == 0 {
+		return CLASS_INTERACTIVE
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return CLASS_INTERACTIVE
+	}
+
+	for _, rule := range sp.bulkrules {
+		if sutils.MatchHostRule(rule, host, port) {
+			return CLASS_BULK
+		}
+	}
+
+	sp.bulklock.Lock()
+	defer sp.bulklock.Unlock()
+	if expire, ok := sp.bulkhosts[host]; ok {
+		if time.Now().Before(expire) {
+			return CLASS_BULK
+		}
+		delete(sp.bulkhosts, host)
+	}
+	return CLASS_INTERACTIVE
+}
+
+// markBulk called when a stream received more than BulkThreshold.
+func (sp *SessionPool) markBulk(c *Conn) {
+	host, _, err := net.SplitHostPort(c.Address)
+	if err != nil {
+		return
+	}
+
+	sp.bulklock.Lock()
+	defer sp.bulklock.Unlock()
+
+	now := time.Now()
+	if _, ok := sp.bulkhosts[host]; !ok && len(sp.bulkhosts) >= BULK_HOSTS_MAX {
+		for h, expire := range sp.bulkhosts {
+			if now.After(expire) {
+				delete(sp.bulkhosts, h)
+			}
+		}
+		if len(sp.bulkhosts) >= BULK_HOSTS_MAX {
+			log.Infof("bulk hosts full, ignore %s.", host)
+			return
+		}
+	}
+
+	if _, ok := sp.bulkhosts[host]; !ok {
+		log.Noticef("%s received %d bytes, %s is bulk now.", c.String(), c.recved, host)
+	}
+	sp.bulkhosts[host] = now.Add(BULK_MEMORY * time.Second)
+}
+
+func (sp *SessionPool) GetBulkHosts() (hosts []string) {
+	sp.bulklock.Lock()
+	defer sp.bulklock.Unlock()
+
+	now := time.Now()
+	for h, expire := range sp.bulkhosts {
+		if now.Before(expire) {
+			hosts = append(hosts, h)
+		}
+	}
+	sort.Strings(hosts)
+	return
+}
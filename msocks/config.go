@@ -11,15 +11,82 @@ import (
 const (
 	DIAL_RETRY   = 2
 	DIAL_TIMEOUT = 30
+	STREAM_RETRY = 1
 	AUTH_TIMEOUT = 10
 	DNS_TIMEOUT  = 30
 
 	WINDOWSIZE = 4 * 1024 * 1024
 
+	MAX_RESULT_MSG = 1024
+	MAX_DNS_SIZE   = 0xffff
+
+	UDP_QUEUE    = 64
+	UDP_NAT_MAX  = 256
+	UDP_NAT_IDLE = 300
+	// udp sockets of all sessions in server.
+	UDP_SOCKETS_MAX = 4096
+
+	BIND_RETRY = 10
+
+	ACCEPT_BACKLOG = 64
+
+	PING_INTERVAL     = 30
+	BREAKER_THRESHOLD = 3
+	BREAKER_BASE      = 5
+	BREAKER_MAX       = 600
+	RTT_BASE          = 50
+
+	REAP_INTERVAL = 10
+	SHUTDOWN_POLL = 100
+	// idle time of rotated session before closed, so streams just got
+	// it can still be put in.
+	DRAIN_GRACE = 5
+	// least seconds between tries to connect better servers.
+	BETTER_INTERVAL = 10
+
+	BULK_MAXCONN   = 4
+	BULK_MEMORY    = 600
+	BULK_HOSTS_MAX = 1024
+
+	// rate of user over quota, in bytes per second.
+	QUOTA_RATE = 4 * 1024
+	// users without session are forgotten when more than this.
+	USAGE_MAX = 4096
+
+	GUARD_FAILS    = 5
+	GUARD_WINDOW   = 600
+	GUARD_BANTIME  = 3600
+	GUARD_DELAY    = 500
+	GUARD_MAXDELAY = 8
+	GUARD_RECORDS  = 4096
+	// attempts of one ip waiting for delay.
+	GUARD_WAITERS = 16
+
+	ACCOUNT_INTERVAL = 60
+	ACCOUNT_SHARDS   = 16
+
+	AUDIT_MAXSIZE  = 100 * 1024 * 1024
+	AUDIT_MAXFILES = 10
+	// records queued in memory, more are dropped.
+	AUDIT_QUEUE = 65536
+	// seconds between retries when audit log can't be written.
+	AUDIT_RETRY = 1
+	// retries before records dropped, only after audit log closed.
+	AUDIT_CLOSE_RETRIES = 3
+
+	DNS_CACHE_MAX  = 4096
+	DNS_NEG_TTL    = 30
+	DNS_SYSTEM_TTL = 60
+
 	SHRINK_TIME = 3
 	DEBUGDNS    = false
 )
 
+const (
+	CLASS_INTERACTIVE = "interactive"
+	CLASS_BULK        = "bulk"
+)
+
 const (
 	ERR_NONE = iota
 	ERR_AUTH
@@ -27,29 +94,54 @@ const (
 	ERR_CONNFAILED
 	ERR_TIMEOUT
 	ERR_CLOSED
+	ERR_DNSFAILED
+	ERR_REFUSED
+	ERR_UNREACHABLE
+	ERR_DENIED
+	ERR_FORBIDDEN
+	ERR_QUOTA
+	ERR_LIMIT
 )
 
 var (
-	ErrNoSession       = errors.New("session in pool but can't pick one.")
-	ErrSessionNotFound = errors.New("session not found.")
-	ErrAuthFailed      = errors.New("auth failed.")
-	ErrAuthTimeout     = errors.New("auth timeout %s.")
-	ErrStreamNotExist  = errors.New("stream not exist.")
-	ErrQueueClosed     = errors.New("queue closed.")
-	ErrUnexpectedPkg   = errors.New("unexpected package.")
-	ErrNotSyn          = errors.New("frame result in conn which status is not syn.")
-	ErrFinState        = errors.New("status not est or fin wait when get fin.")
-	ErrIdExist         = errors.New("frame sync stream id exist.")
-	ErrState           = errors.New("status error.")
-	ErrUnknownState    = errors.New("unknown status.")
-	ErrChanClosed      = errors.New("chan closed.")
-	ErrDnsTimeOut      = errors.New("dns timeout.")
-	ErrDnsMsgIllegal   = errors.New("dns message illegal.")
-	ErrNoDnsServer     = errors.New("no proper dns server.")
+	ErrNoSession        = errors.New("session in pool but can't pick one.")
+	ErrNoServer         = errors.New("can't connect to any server.")
+	ErrSessionNotFound  = errors.New("session not found.")
+	ErrAuthFailed       = errors.New("auth failed.")
+	ErrTooManySessions  = errors.New("too many sessions.")
+	ErrAuthTimeout      = errors.New("auth timeout %s.")
+	ErrStreamNotExist   = errors.New("stream not exist.")
+	ErrQueueClosed      = errors.New("queue closed.")
+	ErrUnexpectedPkg    = errors.New("unexpected package.")
+	ErrNotSyn           = errors.New("frame result in conn which status is not syn.")
+	ErrFinState         = errors.New("status not est or fin wait when get fin.")
+	ErrIdExist          = errors.New("frame sync stream id exist.")
+	ErrState            = errors.New("status error.")
+	ErrUnknownState     = errors.New("unknown status.")
+	ErrChanClosed       = errors.New("chan closed.")
+	ErrDnsTimeOut       = errors.New("dns timeout.")
+	ErrDnsMsgIllegal    = errors.New("dns message illegal.")
+	ErrNoDnsServer      = errors.New("no proper dns server.")
+	ErrWindowExceeded   = errors.New("remote sent data out of window.")
+	ErrBufferFull       = errors.New("buffer limit exceeded.")
+	ErrStreamReset      = errors.New("stream reset by remote.")
+	ErrDatagramTooLarge = errors.New("datagram too large.")
+	ErrDatagramClosed   = errors.New("datagram conn closed.")
+	ErrNoDatagram       = errors.New("remote not support datagram.")
+	ErrTooManySockets   = errors.New("too many udp sockets.")
+	ErrBindDenied       = errors.New("bind not allowed.")
+	ErrBindTimeout      = errors.New("bind timeout.")
+	ErrSessionClosed    = errors.New("session closed.")
+	ErrShutdown         = errors.New("shutting down.")
+	ErrShutdownTimeout  = errors.New("shutdown timeout, streams aborted.")
 )
 
 var (
 	log = logging.MustGetLogger("msocks")
+
+	// sent to server in auth if ClientVersion not empty.
+	ClientVersion  string
+	ClientHostname string
 )
 
 func init() {
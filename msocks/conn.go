@@ -1,11 +1,14 @@
 package msocks
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,6 +28,20 @@ type Conn struct {
 	streamid uint16
 	sender   FrameSender
 	ch       chan uint32
+	dialerr  error
+	dialed   chan struct{} // closed when result of fast open known
+	dialret  error
+	reset    int32 // set once stream reset, read by reader and writer
+	fastopen bool
+	finsent  bool // fin sent before connected, fast open only
+	finrecv  bool // fin recved before connected
+	recved   int64
+	sent     int64
+	start    time.Time
+	reason   string // why stream finished, for audit
+	audited  int32
+	ctx      context.Context // for dialing of syn recved
+	cancel   context.CancelFunc
 	Network  string
 	Address  string
 
@@ -36,6 +53,9 @@ type Conn struct {
 	wlock    sync.Mutex
 	wbufsize uint32
 	wev      *sync.Cond
+	// wmu serialize writers, wlock is released when throttled, since
+	// session loop take it in InWnd and Final.
+	wmu sync.Mutex
 }
 
 func NewConn(status uint8, streamid uint16, sess *Session, network, address string) (c *Conn) {
@@ -46,7 +66,11 @@ func NewConn(status uint8, streamid uint16, sess *Session, network, address stri
 		sender:   sess,
 		Network:  network,
 		Address:  address,
+		start:    time.Now(),
 		rqueue:   NewQueue(),
+		// buffered, result may come before we start to wait. created
+		// before put into session, so result or close never miss it.
+		ch: make(chan uint32, 1),
 	}
 	c.wev = sync.NewCond(&c.wlock)
 	return
@@ -78,9 +102,17 @@ func (c *Conn) String() (s string) {
 	return fmt.Sprintf("%d(%d)", c.sess.LocalPort(), c.streamid)
 }
 
-func (c *Conn) WaitForConn() (err error) {
-	c.ch = make(chan uint32, 0)
+// WaitForConn send syn and wait for result. If ctx canceled, remote will
+// get a rst and stop dialing.
+func (c *Conn) WaitForConn(ctx context.Context) (err error) {
+	err = c.SendSyn()
+	if err != nil {
+		return
+	}
+	return c.WaitResult(ctx)
+}
 
+func (c *Conn) SendSyn() (err error) {
 	fb := NewFrameSyn(c.streamid, c.Network, c.Address)
 	err = c.sess.SendFrame(fb)
 	if err != nil {
@@ -88,21 +120,132 @@ func (c *Conn) WaitForConn() (err error) {
 		c.Final()
 		return
 	}
+	return
+}
 
-	errno := RecvWithTimeout(c.ch, DIAL_TIMEOUT*time.Second)
-	if errno != ERR_NONE {
-		log.Errorf("remote connect %s failed for %d.", c.String(), errno)
-		c.Final()
-	} else {
+func (c *Conn) WaitResult(ctx context.Context) (err error) {
+	var errno uint32
+	select {
+	case errno = <-c.ch:
+	case <-time.After(DIAL_TIMEOUT * time.Second):
+		errno = ERR_TIMEOUT
+	case <-ctx.Done():
+		c.lock.Lock()
+		if c.fastopen && c.status != ST_SYN_SENT {
+			// result came just now, conn already in use by caller.
+			c.lock.Unlock()
+			return c.dialerr
+		}
+		log.Infof("%s dial canceled: %s.", c.String(), ctx.Err())
+		if c.dialerr == nil {
+			c.dialerr = ctx.Err()
+		}
+		// result may come just now, caller will not use it anyway.
+		c.abort()
+		c.lock.Unlock()
+		return c.dialerr
+	}
+
+	switch errno {
+	case ERR_NONE:
 		log.Noticef("%s connected: %s => %s.", c.Network, c.String(), c.Address)
+		return
+	case ERR_TIMEOUT:
+		// remote may still dialing, let it know we gave up.
+		// no answer in time, session may be broken.
+		c.sess.MarkSuspect()
+		c.lock.Lock()
+		if c.dialerr == nil {
+			c.dialerr = &DialError{
+				Errno:   ERR_TIMEOUT,
+				Network: c.Network,
+				Address: c.Address,
+				Local:   true,
+			}
+		}
+		c.abort()
+		c.lock.Unlock()
+	}
+
+	// conn already final in InConnect, InRst or abort.
+	// or session closed, see CloseFrame.
+	err = c.dialerr
+	if err == nil {
+		err = &DialError{Errno: errno, Network: c.Network, Address: c.Address, Local: true}
+	}
+	log.Errorf("%s %s", c.String(), err)
+	return
+}
+
+// WaitDial wait for result of dial in fast open, return error if failed.
+// It returns at once if not in fast open.
+func (c *Conn) WaitDial() error {
+	if c.dialed == nil {
+		return nil
+	}
+	<-c.dialed
+	return c.dialret
+}
+
+func (c *Conn) setDialError(errno uint32, msg string) {
+	if c.dialerr != nil {
+		return
+	}
+	c.dialerr = &DialError{
+		Errno:   errno,
+		Msg:     msg,
+		Network: c.Network,
+		Address: c.Address,
+	}
+}
+
+// Establish accept stream in syn recv status, used by SynHandler.
+func (c *Conn) Establish() (err error) {
+	c.lock.Lock()
+	if c.status != ST_SYN_RECV {
+		// reset by remote while we are handling it.
+		c.lock.Unlock()
+		return ErrStreamReset
+	}
+	if c.finrecv {
+		c.status = ST_CLOSE_WAIT
+	} else {
+		c.status = ST_EST
 	}
+	c.lock.Unlock()
 
-	c.ch = nil
+	fb := NewFrameResult(c.streamid, ERR_NONE)
+	err = c.sess.SendFrame(fb)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// Refuse reject stream in syn recv status, used by SynHandler.
+func (c *Conn) Refuse(errno uint32, msg string) (err error) {
+	fb := c.sess.resultFrame(c.streamid, errno, msg)
+	err = c.sess.SendFrame(fb)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.reason = "refused: " + ErrnoText(errno)
+	if msg != "" {
+		c.reason += " (" + msg + ")"
+	}
+	if c.status != ST_UNKNOWN {
+		c.Final()
+	}
 	return
 }
 
 func (c *Conn) Final() {
+	if c.cancel != nil {
+		c.cancel()
+	}
 	c.rqueue.Close()
+	// data in queue will never be read after final, give it back.
+	c.releaseRead(math.MaxUint32)
 
 	err := c.sess.RemovePort(c.streamid)
 	if err != nil {
@@ -111,6 +254,43 @@ func (c *Conn) Final() {
 
 	log.Noticef("%s final.", c.String())
 	c.status = ST_UNKNOWN
+	if c.reason == "" {
+		c.reason = "closed"
+	}
+	c.audit(c.reason)
+
+	// wake up writer waiting for window.
+	c.wlock.Lock()
+	c.wev.Broadcast()
+	c.wlock.Unlock()
+	return
+}
+
+// Abort close conn immediately. Unread data will be dropped,
+// and remote will get a rst.
+func (c *Conn) Abort() (err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.abort()
+}
+
+func (c *Conn) abort() (err error) {
+	if c.status == ST_UNKNOWN {
+		return
+	}
+	log.Infof("%s abort.", c.String())
+	// reader should not take it as normal end of stream.
+	atomic.StoreInt32(&c.reset, 1)
+	if c.reason == "" {
+		c.reason = "aborted"
+	}
+
+	fb := NewFrameRst(c.streamid)
+	err = c.sender.SendFrame(fb)
+	if err != nil {
+		log.Errorf("%s", err)
+	}
+	c.Final()
 	return
 }
 
@@ -123,7 +303,29 @@ func (c *Conn) Close() (err error) {
 	case ST_UNKNOWN, ST_FIN_WAIT:
 		// maybe call close twice
 		return
+	case ST_SYN_SENT:
+		if !c.fastopen {
+			return c.abort()
+		}
+		if c.finsent {
+			return
+		}
+		// data may sent already, send fin after it, just like est.
+		log.Infof("%s closed from local before connected.", c.String())
+		fb := NewFrameFin(c.streamid)
+		err = c.sender.SendFrame(fb)
+		if err != nil {
+			log.Errorf("%s", err)
+			return
+		}
+		c.finsent = true
+	case ST_SYN_RECV:
+		return c.abort()
 	case ST_EST:
+		if atomic.LoadUint32(&c.rbufsize) > 0 {
+			// close with unread data, just like tcp, reset it.
+			return c.abort()
+		}
 		log.Infof("%s closed from local.", c.String())
 		fb := NewFrameFin(c.streamid)
 		err = c.sender.SendFrame(fb)
@@ -133,6 +335,10 @@ func (c *Conn) Close() (err error) {
 		}
 		c.status = ST_FIN_WAIT
 	case ST_CLOSE_WAIT:
+		if atomic.LoadUint32(&c.rbufsize) > 0 {
+			// close with unread data, just like tcp, reset it.
+			return c.abort()
+		}
 		fb := NewFrameFin(c.streamid)
 		err = c.sender.SendFrame(fb)
 		if err != nil {
@@ -147,29 +353,31 @@ func (c *Conn) Close() (err error) {
 	return
 }
 
+// Any error in stream will reset the stream, not the session.
 func (c *Conn) SendFrame(f Frame) (err error) {
 	switch ft := f.(type) {
 	default:
 		err = ErrUnexpectedPkg
-		log.Errorf("%s", err)
-		c.Close()
-		return
 	case *FrameResult:
-		return c.InConnect(ft.Errno)
+		err = c.InConnect(ft)
 	case *FrameData:
-		return c.InData(ft)
+		err = c.InData(ft)
 	case *FrameWnd:
-		return c.InWnd(ft)
+		err = c.InWnd(ft)
 	case *FrameFin:
-		return c.InFin(ft)
+		err = c.InFin(ft)
 	case *FrameRst:
-		log.Debugf("reset %s.", c.String())
-		c.Final()
+		err = c.InRst(ft)
 	}
-	return
+
+	if err != nil {
+		log.Errorf("%s reset for %s", c.String(), err)
+		c.Abort()
+	}
+	return nil
 }
 
-func (c *Conn) InConnect(errno uint32) (err error) {
+func (c *Conn) InConnect(ft *FrameResult) (err error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
@@ -177,14 +385,20 @@ func (c *Conn) InConnect(errno uint32) (err error) {
 		return ErrNotSyn
 	}
 
-	if errno == ERR_NONE {
-		c.status = ST_EST
-	} else {
+	switch {
+	case ft.Errno != ERR_NONE:
+		c.setDialError(ft.Errno, ft.Message)
 		c.Final()
+	case c.finsent:
+		c.status = ST_FIN_WAIT
+		c.sess.ClearSuspect()
+	default:
+		c.status = ST_EST
+		c.sess.ClearSuspect()
 	}
 
 	select {
-	case c.ch <- errno:
+	case c.ch <- ft.Errno:
 	default:
 	}
 	return
@@ -192,11 +406,69 @@ func (c *Conn) InConnect(errno uint32) (err error) {
 
 func (c *Conn) InData(ft *FrameData) (err error) {
 	log.Infof("%s recved %d bytes.", c.String(), len(ft.Data))
+	size := uint32(len(ft.Data))
+
+	if atomic.LoadUint32(&c.rbufsize)+size > WINDOWSIZE {
+		log.Errorf("%s window exceeded, buffer size: %d, recv size: %d.",
+			c.String(), atomic.LoadUint32(&c.rbufsize), size)
+		return ErrWindowExceeded
+	}
+
+	if !c.sess.budget.Acquire(int64(size)) {
+		log.Errorf("%s buffer limit exceeded, session buffered: %d.",
+			c.String(), c.sess.GetBuffered())
+		return ErrBufferFull
+	}
+
 	err = c.rqueue.Push(ft.Data)
 	if err != nil {
+		c.sess.budget.Release(int64(size))
 		return
 	}
-	c.rbufsize += uint32(len(ft.Data))
+	atomic.AddUint32(&c.rbufsize, size)
+
+	// only written in session loop, atomic for audit.
+	recved := atomic.AddInt64(&c.recved, int64(size))
+	if c.sess.onBulk != nil && recved > c.sess.bulkThreshold &&
+		recved-int64(size) <= c.sess.bulkThreshold {
+		c.sess.onBulk(c)
+	}
+	return
+}
+
+// release at most n bytes from read buffer counter and memory budget.
+func (c *Conn) releaseRead(n uint32) {
+	for {
+		old := atomic.LoadUint32(&c.rbufsize)
+		if n > old {
+			n = old
+		}
+		if atomic.CompareAndSwapUint32(&c.rbufsize, old, old-n) {
+			break
+		}
+	}
+	c.sess.budget.Release(int64(n))
+}
+
+func (c *Conn) InRst(ft *FrameRst) (err error) {
+	log.Infof("%s reset from remote.", c.String())
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	atomic.StoreInt32(&c.reset, 1)
+	if c.reason == "" {
+		c.reason = "reset by remote"
+	}
+	if c.status == ST_SYN_SENT {
+		c.setDialError(ERR_CLOSED, "reset by remote")
+		select {
+		case c.ch <- ERR_CLOSED:
+		default:
+		}
+	}
+	if c.status != ST_UNKNOWN {
+		c.Final()
+	}
 	return
 }
 
@@ -219,6 +491,10 @@ func (c *Conn) InFin(ft *FrameFin) (err error) {
 	defer c.lock.Unlock()
 
 	switch c.status {
+	case ST_SYN_RECV:
+		// fast open, remote sent all data before we connected.
+		c.finrecv = true
+		return
 	case ST_EST:
 		log.Infof("%s closed from remote.", c.String())
 		// close read pipe but not sent fin back
@@ -237,9 +513,25 @@ func (c *Conn) InFin(ft *FrameFin) (err error) {
 	return ErrFinState
 }
 
+// session closed, no more frame will come in or go out.
 func (c *Conn) CloseFrame() error {
-	// maybe conn closed
+	atomic.StoreInt32(&c.reset, 1)
 	c.rqueue.Close()
+	c.audit("session closed")
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	// wake up WaitResult if still in syn sent.
+	select {
+	case c.ch <- ERR_CLOSED:
+	default:
+	}
+
+	c.wlock.Lock()
+	c.wev.Broadcast()
+	c.wlock.Unlock()
 	return nil
 }
 
@@ -255,7 +547,14 @@ func (c *Conn) Read(data []byte) (n int, err error) {
 			// reader should be blocked in here
 			v, err = c.rqueue.Pop(block)
 			if err == ErrQueueClosed {
-				err = io.EOF
+				switch {
+				case c.dialerr != nil:
+					err = c.dialerr
+				case atomic.LoadInt32(&c.reset) != 0:
+					err = ErrStreamReset
+				default:
+					err = io.EOF
+				}
 			}
 			if err != nil {
 				return
@@ -279,7 +578,10 @@ func (c *Conn) Read(data []byte) (n int, err error) {
 		}
 	}
 
-	c.rbufsize -= uint32(n)
+	// throttle before window released, so remote will be slowed down.
+	c.sess.traffic(c.Address, true, n)
+
+	c.releaseRead(uint32(n))
 	fb := NewFrameWnd(c.streamid, uint32(n))
 	err = c.sender.SendFrame(fb)
 	if err != nil {
@@ -289,8 +591,8 @@ func (c *Conn) Read(data []byte) (n int, err error) {
 }
 
 func (c *Conn) Write(data []byte) (n int, err error) {
-	c.wlock.Lock()
-	defer c.wlock.Unlock()
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
 
 	for len(data) > 0 {
 		size := uint32(len(data))
@@ -302,7 +604,11 @@ func (c *Conn) Write(data []byte) (n int, err error) {
 			size /= 2
 		}
 
+		// may sleep for rate limit, out of wlock.
+		c.sess.traffic(c.Address, false, int(size))
+		c.wlock.Lock()
 		err = c.WriteSlice(data[:size])
+		c.wlock.Unlock()
 
 		if err != nil {
 			log.Errorf("%s", err)
@@ -320,13 +626,24 @@ func (c *Conn) Write(data []byte) (n int, err error) {
 func (c *Conn) WriteSlice(data []byte) (err error) {
 	f := NewFrameData(c.streamid, data)
 
-	if c.status != ST_EST && c.status != ST_CLOSE_WAIT {
-		log.Errorf("status %d found in write slice", c.status)
-		return ErrState
-	}
-
 	log.Debugf("write buffer size: %d, write len: %d", c.wbufsize, len(data))
-	for c.wbufsize+uint32(len(data)) > WINDOWSIZE {
+	for {
+		if c.dialerr != nil {
+			return c.dialerr
+		}
+		if atomic.LoadInt32(&c.reset) != 0 {
+			return ErrStreamReset
+		}
+		// in fast open, remote will buffer data until connected.
+		writable := c.status == ST_EST || c.status == ST_CLOSE_WAIT ||
+			(c.status == ST_SYN_SENT && c.fastopen)
+		if !writable {
+			log.Errorf("status %d found in write slice", c.status)
+			return ErrState
+		}
+		if c.wbufsize+uint32(len(data)) <= WINDOWSIZE {
+			break
+		}
 		c.wev.Wait()
 	}
 
@@ -336,6 +653,7 @@ func (c *Conn) WriteSlice(data []byte) (err error) {
 		return
 	}
 	c.wbufsize += uint32(len(data))
+	atomic.AddInt64(&c.sent, int64(len(data)))
 	c.wev.Signal()
 	return
 }
@@ -371,7 +689,7 @@ func (c *Conn) GetStatus() (st string) {
 }
 
 func (c *Conn) GetReadBufSize() (n uint32) {
-	return c.rbufsize
+	return atomic.LoadUint32(&c.rbufsize)
 }
 
 func (c *Conn) GetWriteBufSize() (n uint32) {
@@ -0,0 +1,187 @@
+package msocks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+)
+
+// frameRecorder record frames sent by conn, instead of session.
+type frameRecorder struct {
+	lock   sync.Mutex
+	frames []Frame
+}
+
+func (fr *frameRecorder) SendFrame(f Frame) error {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	fr.frames = append(fr.frames, f)
+	return nil
+}
+
+func (fr *frameRecorder) CloseFrame() error {
+	return nil
+}
+
+func (fr *frameRecorder) hasRst() bool {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	for _, f := range fr.frames {
+		if _, ok := f.(*FrameRst); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// newTestConn create conn in status, frames sent are recorded.
+func newTestConn(s *Session, id uint16, status uint8) (c *Conn, fr *frameRecorder) {
+	c = NewConn(status, id, s, "tcp", "example.com:80")
+	fr = &frameRecorder{}
+	c.sender = fr
+	s.PutIntoId(id, c)
+	return
+}
+
+func TestWindowExceeded(t *testing.T) {
+	c1, _ := net.Pipe()
+	s := NewSession(c1)
+	c, _ := newTestConn(s, 1, ST_EST)
+
+	data := make([]byte, WINDOWSIZE/2)
+	for i := 0; i < 2; i++ {
+		if err := c.InData(NewFrameData(1, data)); err != nil {
+			t.Fatalf("data in window refused: %s", err)
+		}
+	}
+	if err := c.InData(NewFrameData(1, data[:1])); err != ErrWindowExceeded {
+		t.Fatalf("data out of window should fail, got %v", err)
+	}
+	if s.GetBuffered() != WINDOWSIZE {
+		t.Fatalf("data out of window should not be charged: %d", s.GetBuffered())
+	}
+}
+
+func TestBufferNoLimit(t *testing.T) {
+	c1, _ := net.Pipe()
+	s := NewSession(c1)
+
+	// slow readers with full window are fine without limit.
+	data := make([]byte, WINDOWSIZE)
+	for i := uint16(1); i <= 32; i++ {
+		c, _ := newTestConn(s, i, ST_EST)
+		if err := c.InData(NewFrameData(i, data)); err != nil {
+			t.Fatalf("data in window refused: %s", err)
+		}
+	}
+	if s.GetBuffered() != 32*WINDOWSIZE {
+		t.Fatalf("buffered wrong: %d", s.GetBuffered())
+	}
+}
+
+func TestBufferLimit(t *testing.T) {
+	c1, _ := net.Pipe()
+	s := NewSession(c1)
+	pool := NewMemBudget(150, nil)
+	s.budget = NewMemBudget(100, pool)
+	ca, _ := newTestConn(s, 1, ST_EST)
+	cb, _ := newTestConn(s, 2, ST_EST)
+
+	data := make([]byte, 60)
+	if err := ca.InData(NewFrameData(1, data)); err != nil {
+		t.Fatalf("data in limit refused: %s", err)
+	}
+	if err := cb.InData(NewFrameData(2, data)); err != ErrBufferFull {
+		t.Fatalf("data over session limit should fail, got %v", err)
+	}
+	if s.GetBuffered() != 60 || pool.GetUsed() != 60 {
+		t.Fatalf("refused data should not be charged")
+	}
+
+	n, err := ca.Read(make([]byte, 30))
+	if err != nil || n != 30 {
+		t.Fatalf("Read failed: %d %v", n, err)
+	}
+	if s.GetBuffered() != 30 || pool.GetUsed() != 30 {
+		t.Fatalf("data read should be released: %d", s.GetBuffered())
+	}
+	if err := cb.InData(NewFrameData(2, data)); err != nil {
+		t.Fatalf("data in limit refused after read: %s", err)
+	}
+
+	// pool limit shared with other sessions.
+	other := NewMemBudget(100, pool)
+	if other.Acquire(70) {
+		t.Fatalf("pool limit exceeded")
+	}
+	ca.Final()
+	if s.GetBuffered() != 60 || !other.Acquire(70) {
+		t.Fatalf("buffer of stream closed not released")
+	}
+}
+
+func TestCloseUnread(t *testing.T) {
+	c1, _ := net.Pipe()
+	s := NewSession(c1)
+
+	for _, status := range []uint8{ST_EST, ST_CLOSE_WAIT} {
+		c, fr := newTestConn(s, 1, status)
+		c.InData(NewFrameData(1, []byte("unread")))
+		c.Close()
+		if !fr.hasRst() || s.GetSize() != 0 || s.GetBuffered() != 0 {
+			t.Fatalf("close with unread data in status %d should reset", status)
+		}
+	}
+
+	// all data read, closed normally.
+	c, fr := newTestConn(s, 1, ST_EST)
+	c.InData(NewFrameData(1, []byte("data")))
+	c.Read(make([]byte, 4))
+	c.Close()
+	if fr.hasRst() || c.status != ST_FIN_WAIT {
+		t.Fatalf("close without unread data should send fin")
+	}
+}
+
+func TestRstProtocolError(t *testing.T) {
+	c1, _ := net.Pipe()
+	s := NewSession(c1)
+	other, _ := newTestConn(s, 2, ST_EST)
+
+	for _, f := range []Frame{
+		NewFrameData(1, make([]byte, WINDOWSIZE+1)),
+		NewFrameSyn(1, "tcp", "example.com:80"),
+		NewFrameResult(1, ERR_NONE),
+	} {
+		c, fr := newTestConn(s, 1, ST_EST)
+		c.SendFrame(f)
+		if !fr.hasRst() || c.status != ST_UNKNOWN {
+			t.Fatalf("%s should reset stream", f.Debug())
+		}
+		if _, err := c.Read(make([]byte, 1)); err != ErrStreamReset {
+			t.Fatalf("read after reset should fail, got %v", err)
+		}
+	}
+	// other streams in session not affected.
+	if s.GetSize() != 1 || other.status != ST_EST {
+		t.Fatalf("protocol error should not affect other streams")
+	}
+}
+
+func TestRstSynTimeout(t *testing.T) {
+	c1, _ := net.Pipe()
+	s := NewSession(c1)
+	c, fr := newTestConn(s, 1, ST_SYN_SENT)
+
+	// same as no result in DIAL_TIMEOUT.
+	c.ch <- ERR_TIMEOUT
+	err := c.WaitResult(context.Background())
+	if de, ok := err.(*DialError); !ok || de.Errno != ERR_TIMEOUT {
+		t.Fatalf("WaitResult should time out, got %v", err)
+	}
+	// remote may still dialing, let it know.
+	if !fr.hasRst() || s.GetSize() != 0 {
+		t.Fatalf("stream timed out should be reset")
+	}
+}
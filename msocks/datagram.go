@@ -0,0 +1,527 @@
+package msocks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shell909090/goproxy/sutils"
+)
+
+type DatagramAddr string
+
+func (a DatagramAddr) Network() string {
+	return "udp"
+}
+
+func (a DatagramAddr) String() string {
+	return string(a)
+}
+
+// DatagramConn is a udp flow over msocks, client side.
+// src identify the flow in session, remote map it to an udp socket.
+// It works as net.PacketConn, and net.Conn if created by DialDatagram.
+type DatagramConn struct {
+	sess *Session
+	src  string
+	dst  string
+
+	lock   sync.Mutex
+	closed bool
+	ch     chan *FrameUdp
+}
+
+// ListenDatagram fail with ErrNoDatagram if remote can't accept udp frames.
+func (s *Session) ListenDatagram() (dc *DatagramConn, err error) {
+	if !s.datagram {
+		return nil, ErrNoDatagram
+	}
+	dc = &DatagramConn{
+		sess: s,
+		src:  fmt.Sprintf("%d", atomic.AddUint32(&s.next_dgram, 1)),
+		ch:   make(chan *FrameUdp, UDP_QUEUE),
+	}
+
+	s.dlock.Lock()
+	defer s.dlock.Unlock()
+	if s.dclosed {
+		return nil, ErrDatagramClosed
+	}
+	s.dgrams[dc.src] = dc
+	atomic.StoreInt64(&s.lastused, time.Now().UnixNano())
+	log.Debugf("%s datagram %s created.", s.String(), dc.src)
+	return
+}
+
+func (s *Session) DialDatagram(address string) (dc *DatagramConn, err error) {
+	dc, err = s.ListenDatagram()
+	if err != nil {
+		return
+	}
+	dc.dst = address
+	log.Infof("%s datagram %s => %s.", s.String(), dc.src, address)
+	return
+}
+
+func (dc *DatagramConn) String() string {
+	return fmt.Sprintf("%s(%s)", dc.sess.String(), dc.src)
+}
+
+// drop if queue full or out of memory budget, just like udp.
+// Budget will be released when datagram read or dropped by close.
+func (dc *DatagramConn) in(ft *FrameUdp) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	if dc.closed {
+		return
+	}
+	if !dc.sess.budget.Acquire(int64(len(ft.Data))) {
+		log.Debugf("%s buffer limit exceeded, drop datagram.", dc.String())
+		return
+	}
+	select {
+	case dc.ch <- ft:
+	default:
+		dc.sess.budget.Release(int64(len(ft.Data)))
+		log.Debugf("%s queue full, drop datagram.", dc.String())
+	}
+}
+
+func (dc *DatagramConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	ft, ok := <-dc.ch
+	if !ok {
+		return 0, nil, io.EOF
+	}
+	dc.sess.budget.Release(int64(len(ft.Data)))
+	n = copy(b, ft.Data)
+	return n, DatagramAddr(ft.Src), nil
+}
+
+func (dc *DatagramConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	f, err := NewFrameUdp(0, dc.src, addr.String(), b)
+	if err != nil {
+		return
+	}
+	err = dc.sess.SendFrame(f)
+	if err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (dc *DatagramConn) Read(b []byte) (n int, err error) {
+	n, _, err = dc.ReadFrom(b)
+	return
+}
+
+func (dc *DatagramConn) Write(b []byte) (n int, err error) {
+	return dc.WriteTo(b, DatagramAddr(dc.dst))
+}
+
+func (dc *DatagramConn) Close() (err error) {
+	dc.sess.dlock.Lock()
+	delete(dc.sess.dgrams, dc.src)
+	dc.sess.dlock.Unlock()
+	atomic.StoreInt64(&dc.sess.lastused, time.Now().UnixNano())
+	dc.close()
+	return
+}
+
+func (dc *DatagramConn) close() {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	if dc.closed {
+		return
+	}
+	dc.closed = true
+	close(dc.ch)
+	// nobody may read them, release budget now.
+	for ft := range dc.ch {
+		dc.sess.budget.Release(int64(len(ft.Data)))
+	}
+	log.Debugf("%s datagram closed.", dc.String())
+}
+
+func (dc *DatagramConn) LocalAddr() net.Addr {
+	return DatagramAddr(dc.src)
+}
+
+func (dc *DatagramConn) RemoteAddr() net.Addr {
+	return DatagramAddr(dc.dst)
+}
+
+func (dc *DatagramConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (dc *DatagramConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (dc *DatagramConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// natEntry is an udp socket in server, for one flow from client.
+// dsts map address resolved to destination requested by client, so
+// traffic of both directions is counted by destination requested.
+// Destinations chosen to upstream are sent by ups, one conn for each.
+// Datagrams queued in ch are charged to memory budget of session, and
+// each socket is counted by server. Traffic of each destination goes to
+// audit log when entry closed.
+type natEntry struct {
+	sess *Session
+	src  string
+	conn *net.UDPConn
+	last int64
+	ch   chan *FrameUdp
+
+	lock  sync.Mutex
+	dsts  map[string]string
+	ups   map[string]net.Conn
+	stats map[string]*natStat
+}
+
+func (s *Session) getNat(src string) (ne *natEntry, err error) {
+	s.dlock.Lock()
+	defer s.dlock.Unlock()
+
+	if s.dclosed {
+		return nil, ErrDatagramClosed
+	}
+	ne, ok := s.nat[src]
+	if ok {
+		return
+	}
+
+	if len(s.nat) >= UDP_NAT_MAX {
+		// evict the one idle for longest time.
+		var oldest *natEntry
+		for _, e := range s.nat {
+			if oldest == nil || atomic.LoadInt64(&e.last) < atomic.LoadInt64(&oldest.last) {
+				oldest = e
+			}
+		}
+		log.Infof("%s nat table full, evict %s.", s.String(), oldest.src)
+		delete(s.nat, oldest.src)
+		oldest.close("evicted")
+	}
+
+	if !s.server.acquireSocket() {
+		return nil, ErrTooManySockets
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		s.server.releaseSocket()
+		return
+	}
+
+	ne = &natEntry{
+		sess:  s,
+		src:   src,
+		conn:  conn,
+		last:  time.Now().UnixNano(),
+		ch:    make(chan *FrameUdp, UDP_QUEUE),
+		dsts:  make(map[string]string),
+		ups:   make(map[string]net.Conn),
+		stats: make(map[string]*natStat),
+	}
+	s.nat[src] = ne
+	log.Infof("%s nat %s => %s created.", s.String(), src, conn.LocalAddr())
+
+	go ne.sender()
+	go ne.receiver()
+	return
+}
+
+func (ne *natEntry) setDst(addr, dst string) {
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+	if len(ne.dsts) >= UDP_NAT_MAX {
+		ne.dsts = make(map[string]string)
+	}
+	ne.dsts[addr] = dst
+}
+
+// dstOf return destination requested for address replied, or address
+// itself if it's not requested.
+func (ne *natEntry) dstOf(addr string) string {
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+	if dst, ok := ne.dsts[addr]; ok {
+		return dst
+	}
+	return addr
+}
+
+// upstream return conn to dst by dialer, create it if not exist.
+// Only sender call it, so conn will not be created twice.
+func (ne *natEntry) upstream(dialer sutils.Dialer, dst string) (conn net.Conn, err error) {
+	ne.lock.Lock()
+	conn, ok := ne.ups[dst]
+	ne.lock.Unlock()
+	if ok {
+		return
+	}
+
+	if !ne.sess.server.acquireSocket() {
+		return nil, ErrTooManySockets
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT*time.Second)
+	defer cancel()
+	conn, err = dialer.DialContext(ctx, "udp", dst)
+	if err != nil {
+		ne.sess.server.releaseSocket()
+		return
+	}
+
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+	if ne.ups == nil {
+		// entry closed while dialing.
+		conn.Close()
+		ne.sess.server.releaseSocket()
+		return nil, ErrDatagramClosed
+	}
+	if len(ne.ups) >= UDP_NAT_MAX {
+		for d, c := range ne.ups {
+			log.Infof("%s nat %s upstream full, evict %s.", ne.sess.String(), ne.src, d)
+			delete(ne.ups, d)
+			c.Close()
+			break
+		}
+	}
+	ne.ups[dst] = conn
+	log.Infof("%s nat %s => %s by upstream.", ne.sess.String(), ne.src, dst)
+	go ne.upReceiver(dst, conn)
+	return
+}
+
+func (ne *natEntry) touch() {
+	atomic.StoreInt64(&ne.last, time.Now().UnixNano())
+}
+
+// close will be called under sess.dlock.
+func (ne *natEntry) close(reason string) {
+	ne.conn.Close()
+	close(ne.ch)
+
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+	for _, c := range ne.ups {
+		c.Close()
+	}
+	ne.ups = nil
+	ne.audit(reason)
+}
+
+func (ne *natEntry) remove(reason string) {
+	ne.sess.dlock.Lock()
+	defer ne.sess.dlock.Unlock()
+	if e, ok := ne.sess.nat[ne.src]; !ok || e != ne {
+		return
+	}
+	delete(ne.sess.nat, ne.src)
+	ne.close(reason)
+	atomic.StoreInt64(&ne.sess.lastused, time.Now().UnixNano())
+	log.Infof("%s nat %s removed.", ne.sess.String(), ne.src)
+}
+
+// target return conn to dst if it's chosen to upstream, or address
+// resolved to send by socket of entry.
+func (ne *natEntry) target(dst string) (up net.Conn, addr *net.UDPAddr, err error) {
+	dialer := ne.sess.chooseDialer(dst)
+	dsts, err := ne.sess.server.CheckACL(context.Background(), ne.sess.Username, "udp", dst)
+	if err != nil {
+		ne.sess.auditRefused("udp", dst, err.Error())
+		return
+	}
+	if _, ok := dialer.(*sutils.TcpDialer); !ok {
+		// keep domain for upstream, let upstream rules match it.
+		up, err = ne.upstream(dialer, dst)
+		return
+	}
+	addr, err = net.ResolveUDPAddr("udp", dsts[0])
+	if err != nil {
+		return
+	}
+	ne.setDst(addr.String(), dst)
+	return
+}
+
+// resolve may take a while, so do it out of session loop.
+func (ne *natEntry) sender() {
+	var lastdst string
+	var up net.Conn
+	var addr *net.UDPAddr
+	var err error
+
+	for ft := range ne.ch {
+		ne.sess.budget.Release(int64(len(ft.Data)))
+		if ft.Dst != lastdst {
+			up, addr, err = ne.target(ft.Dst)
+			if err != nil {
+				log.Errorf("%s", err)
+				lastdst = ""
+				continue
+			}
+			lastdst = ft.Dst
+		}
+
+		ne.sess.traffic(ft.Dst, true, len(ft.Data))
+		ne.count(ft.Dst, true, len(ft.Data))
+		if up != nil {
+			_, err = up.Write(ft.Data)
+		} else {
+			_, err = ne.conn.WriteToUDP(ft.Data, addr)
+		}
+		if err != nil {
+			log.Errorf("%s", err)
+			// conn to upstream may be closed, dial again next time.
+			lastdst = ""
+			continue
+		}
+		ne.touch()
+	}
+}
+
+// upReceiver send datagrams from upstream back, as they come from dst.
+// conn quit with it, so socket is released here.
+func (ne *natEntry) upReceiver(dst string, conn net.Conn) {
+	var buf [0xffff]byte
+	defer func() {
+		ne.lock.Lock()
+		if c, ok := ne.ups[dst]; ok && c == conn {
+			delete(ne.ups, dst)
+		}
+		ne.lock.Unlock()
+		conn.Close()
+		ne.sess.server.releaseSocket()
+	}()
+
+	for {
+		n, err := conn.Read(buf[:])
+		if err != nil {
+			return
+		}
+		ne.touch()
+
+		ne.sess.traffic(dst, false, n)
+		ne.count(dst, false, n)
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		f, err := NewFrameUdp(0, dst, ne.src, data)
+		if err != nil {
+			log.Errorf("%s", err)
+			continue
+		}
+		err = ne.sess.SendFrame(f)
+		if err != nil {
+			log.Errorf("%s", err)
+			return
+		}
+	}
+}
+
+func (ne *natEntry) receiver() {
+	var buf [0xffff]byte
+	reason := "closed"
+	defer ne.sess.server.releaseSocket()
+	defer func() {
+		ne.remove(reason)
+	}()
+
+	for {
+		ne.conn.SetReadDeadline(time.Now().Add(UDP_NAT_IDLE * time.Second))
+		n, addr, err := ne.conn.ReadFromUDP(buf[:])
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				idle := time.Now().UnixNano() - atomic.LoadInt64(&ne.last)
+				if idle < int64(UDP_NAT_IDLE*time.Second) {
+					continue
+				}
+				log.Infof("%s nat %s idle timeout.", ne.sess.String(), ne.src)
+				reason = "idle timeout"
+			}
+			return
+		}
+		ne.touch()
+
+		dst := ne.dstOf(addr.String())
+		ne.sess.traffic(dst, false, n)
+		ne.count(dst, false, n)
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		f, err := NewFrameUdp(0, addr.String(), ne.src, data)
+		if err != nil {
+			log.Errorf("%s", err)
+			continue
+		}
+		err = ne.sess.SendFrame(f)
+		if err != nil {
+			log.Errorf("%s", err)
+			return
+		}
+	}
+}
+
+func (s *Session) on_udp(ft *FrameUdp) (err error) {
+	s.dlock.Lock()
+	dc, ok := s.dgrams[ft.Dst]
+	s.dlock.Unlock()
+	if ok {
+		dc.in(ft)
+		return
+	}
+
+	if s.dialer == nil {
+		// client side, flow closed already.
+		log.Debugf("%s datagram %s not exist, drop.", s.String(), ft.Dst)
+		return
+	}
+
+	ne, err := s.getNat(ft.Src)
+	if err != nil {
+		log.Errorf("%s", err)
+		return nil
+	}
+
+	s.dlock.Lock()
+	defer s.dlock.Unlock()
+	if e, ok := s.nat[ft.Src]; !ok || e != ne {
+		// removed just now.
+		return
+	}
+	if !s.budget.Acquire(int64(len(ft.Data))) {
+		log.Debugf("%s nat %s buffer limit exceeded, drop datagram.", s.String(), ft.Src)
+		return
+	}
+	select {
+	case ne.ch <- ft:
+	default:
+		s.budget.Release(int64(len(ft.Data)))
+		log.Debugf("%s nat %s queue full, drop datagram.", s.String(), ft.Src)
+	}
+	return
+}
+
+// called when session closed.
+func (s *Session) closeDatagrams() {
+	s.dlock.Lock()
+	defer s.dlock.Unlock()
+	s.dclosed = true
+
+	for _, dc := range s.dgrams {
+		dc.close()
+	}
+	s.dgrams = make(map[string]*DatagramConn, 0)
+
+	for _, ne := range s.nat {
+		ne.close("session closed")
+	}
+	s.nat = make(map[string]*natEntry, 0)
+}
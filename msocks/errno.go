@@ -0,0 +1,92 @@
+package msocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+var errnoText = map[uint32]string{
+	ERR_NONE:        "ok",
+	ERR_AUTH:        "auth failed",
+	ERR_IDEXIST:     "stream id exist",
+	ERR_CONNFAILED:  "connect failed",
+	ERR_TIMEOUT:     "timeout",
+	ERR_CLOSED:      "closed",
+	ERR_DNSFAILED:   "dns lookup failed",
+	ERR_REFUSED:     "connection refused",
+	ERR_UNREACHABLE: "network unreachable",
+	ERR_DENIED:      "access denied",
+	ERR_FORBIDDEN:   "forbidden by acl",
+	ERR_QUOTA:       "quota exceeded",
+	ERR_LIMIT:       "limit exceeded",
+}
+
+func ErrnoText(errno uint32) string {
+	if s, ok := errnoText[errno]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown error %d", errno)
+}
+
+// DialError is returned by Session.Dial when remote can't connect target.
+// Local means it's not reported by remote, but timeout or session closed
+// in local side. The target may be fine, the session may not.
+type DialError struct {
+	Errno   uint32
+	Msg     string
+	Network string
+	Address string
+	Local   bool
+}
+
+func (e *DialError) Error() string {
+	where := "remote"
+	if e.Local {
+		where = "local"
+	}
+	s := fmt.Sprintf("%s dial %s:%s failed: %s",
+		where, e.Network, e.Address, ErrnoText(e.Errno))
+	if e.Msg != "" {
+		s += " (" + e.Msg + ")"
+	}
+	return s
+}
+
+func (e *DialError) Timeout() bool {
+	return e.Errno == ERR_TIMEOUT
+}
+
+func (e *DialError) Temporary() bool {
+	return e.Errno == ERR_TIMEOUT || e.Errno == ERR_CLOSED
+}
+
+// ErrnoFromError classify an error from dialer into errno.
+func ErrnoFromError(err error) uint32 {
+	var de *DialError
+	if errors.As(err, &de) {
+		return de.Errno
+	}
+
+	var dnserr *net.DNSError
+	if errors.As(err, &dnserr) {
+		if dnserr.IsTimeout {
+			return ERR_TIMEOUT
+		}
+		return ERR_DNSFAILED
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ERR_REFUSED
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return ERR_UNREACHABLE
+	}
+
+	var neterr net.Error
+	if errors.As(err, &neterr) && neterr.Timeout() {
+		return ERR_TIMEOUT
+	}
+	return ERR_CONNFAILED
+}
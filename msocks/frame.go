@@ -21,6 +21,23 @@ const (
 	MSG_PING
 	MSG_DNS
 	MSG_SPAM
+	MSG_UDP
+	MSG_BIND
+)
+
+// Capabilities are carried in streamid of auth frame, which is 0 in old
+// clients and ignored by old servers, so both sides can tell what the
+// other can do without breaking old versions.
+const (
+	// client can parse message in result frame.
+	CAP_RESULTMSG = 1 << iota
+)
+
+// Capabilities of server are in streamid of auth result. Old servers
+// reply streamid of auth frame as it is, so bits of server start from 8.
+const (
+	// server accept udp frames.
+	CAP_DATAGRAM = 1 << (iota + 8)
 )
 
 func ReadString(r io.Reader) (s string, err error) {
@@ -86,6 +103,10 @@ func ReadFrame(r io.Reader) (f Frame, err error) {
 		f = &FrameDns{FrameBase: *fb}
 	case MSG_SPAM:
 		f = &FrameSpam{FrameBase: *fb}
+	case MSG_UDP:
+		f = &FrameUdp{FrameBase: *fb}
+	case MSG_BIND:
+		f = &FrameBind{FrameSyn{FrameBase: *fb}}
 	}
 	err = f.Unpack(r)
 	return
@@ -123,7 +144,8 @@ func (f *FrameBase) Debug() string {
 
 type FrameResult struct {
 	FrameBase
-	Errno uint32
+	Errno   uint32
+	Message string
 }
 
 func NewFrameResult(streamid uint16, errno uint32) (f *FrameResult) {
@@ -136,12 +158,30 @@ func NewFrameResult(streamid uint16, errno uint32) (f *FrameResult) {
 		Errno: errno,
 	}
 }
+
+// Message is optional, frame without it is the same as old version.
+// Old version reject frame with message, see Session.resultFrame.
+func NewFrameResultMsg(streamid uint16, errno uint32, msg string) (f *FrameResult) {
+	f = NewFrameResult(streamid, errno)
+	if msg != "" {
+		if len(msg) > MAX_RESULT_MSG {
+			msg = msg[:MAX_RESULT_MSG]
+		}
+		f.Message = msg
+		f.Length += uint16(len(msg) + 2)
+	}
+	return
+}
+
 func (f *FrameResult) Packed() (buf *bytes.Buffer, err error) {
 	buf, err = f.FrameBase.Packed()
 	if err != nil {
 		return
 	}
 	binary.Write(buf, binary.BigEndian, f.Errno)
+	if f.Length > 4 {
+		err = WriteString(buf, f.Message)
+	}
 	return
 }
 
@@ -151,17 +191,33 @@ func (f *FrameResult) Unpack(r io.Reader) (err error) {
 		return
 	}
 
-	if f.Length != 4 {
-		err = errors.New("frame result with length not 4.")
+	if f.Length == 4 {
+		return
+	}
+
+	f.Message, err = ReadString(r)
+	if err != nil {
+		return
+	}
+
+	if f.Length != uint16(len(f.Message)+6) {
+		err = errors.New("frame result length not match.")
 		return
 	}
 	return
 }
 
+func (f *FrameResult) Debug() string {
+	return fmt.Sprintf("frame result: stream(%d), len(%d), errno(%d), msg(%s).",
+		f.Streamid, f.Length, f.Errno, f.Message)
+}
+
 type FrameAuth struct {
 	FrameBase
 	Username string
 	Password string
+	Version  string
+	Hostname string
 }
 
 func NewFrameAuth(streamid uint16, username, password string) (f *FrameAuth) {
@@ -176,6 +232,16 @@ func NewFrameAuth(streamid uint16, username, password string) (f *FrameAuth) {
 	}
 }
 
+// Version and hostname of client are optional, frame without them is the
+// same as old version. Old server can't accept frame with them.
+func NewFrameAuthInfo(streamid uint16, username, password, version, hostname string) (f *FrameAuth) {
+	f = NewFrameAuth(streamid, username, password)
+	f.Version = version
+	f.Hostname = hostname
+	f.Length += uint16(len(version) + len(hostname) + 4)
+	return
+}
+
 func (f *FrameAuth) Packed() (buf *bytes.Buffer, err error) {
 	buf, err = f.FrameBase.Packed()
 	if err != nil {
@@ -186,6 +252,16 @@ func (f *FrameAuth) Packed() (buf *bytes.Buffer, err error) {
 		return
 	}
 	err = WriteString(buf, f.Password)
+	if err != nil {
+		return
+	}
+	if f.Length > uint16(len(f.Username)+len(f.Password)+4) {
+		err = WriteString(buf, f.Version)
+		if err != nil {
+			return
+		}
+		err = WriteString(buf, f.Hostname)
+	}
 	return
 }
 
@@ -200,7 +276,20 @@ func (f *FrameAuth) Unpack(r io.Reader) (err error) {
 		return
 	}
 
-	if f.Length != uint16(len(f.Username)+len(f.Password)+4) {
+	size := uint16(len(f.Username) + len(f.Password) + 4)
+	if f.Length > size {
+		f.Version, err = ReadString(r)
+		if err != nil {
+			return
+		}
+		f.Hostname, err = ReadString(r)
+		if err != nil {
+			return
+		}
+		size += uint16(len(f.Version) + len(f.Hostname) + 4)
+	}
+
+	if f.Length != size {
 		err = errors.New("frame auth length not match.")
 	}
 	return
@@ -289,6 +378,23 @@ func (f *FrameSyn) Debug() string {
 		f.Streamid, f.Length, f.Network, f.Address)
 }
 
+// FrameBind ask remote to listen at address, and open streams back for
+// each connection accepted. It has the same layout as FrameSyn.
+type FrameBind struct {
+	FrameSyn
+}
+
+func NewFrameBind(streamid uint16, net, addr string) (f *FrameBind) {
+	f = &FrameBind{*NewFrameSyn(streamid, net, addr)}
+	f.Type = MSG_BIND
+	return
+}
+
+func (f *FrameBind) Debug() string {
+	return fmt.Sprintf("frame bind: stream(%d), len(%d), net(%s), addr(%s).",
+		f.Streamid, f.Length, f.Network, f.Address)
+}
+
 type FrameWnd struct {
 	FrameBase
 	Window uint32
@@ -387,6 +493,13 @@ func NewFramePing() (f *FramePing) {
 	}
 }
 
+// NewFramePong is reply of ping, streamid not 0.
+func NewFramePong() (f *FramePing) {
+	f = NewFramePing()
+	f.Streamid = 1
+	return
+}
+
 func (f *FramePing) Unpack(r io.Reader) (err error) {
 	if f.Length != 0 {
 		return errors.New("frame ping with length not 0.")
@@ -456,6 +569,72 @@ func (f *FrameSpam) Unpack(r io.Reader) (err error) {
 	return
 }
 
+type FrameUdp struct {
+	FrameBase
+	Src  string
+	Dst  string
+	Data []byte
+}
+
+func NewFrameUdp(streamid uint16, src, dst string, data []byte) (f *FrameUdp, err error) {
+	length := len(src) + len(dst) + 4 + len(data)
+	if length > 0xffff {
+		return nil, ErrDatagramTooLarge
+	}
+	return &FrameUdp{
+		FrameBase: FrameBase{
+			Type:     MSG_UDP,
+			Streamid: streamid,
+			Length:   uint16(length),
+		},
+		Src:  src,
+		Dst:  dst,
+		Data: data,
+	}, nil
+}
+
+func (f *FrameUdp) Packed() (buf *bytes.Buffer, err error) {
+	buf, err = f.FrameBase.Packed()
+	if err != nil {
+		return
+	}
+	err = WriteString(buf, f.Src)
+	if err != nil {
+		return
+	}
+	err = WriteString(buf, f.Dst)
+	if err != nil {
+		return
+	}
+	_, err = buf.Write(f.Data)
+	return
+}
+
+func (f *FrameUdp) Unpack(r io.Reader) (err error) {
+	f.Src, err = ReadString(r)
+	if err != nil {
+		return
+	}
+
+	f.Dst, err = ReadString(r)
+	if err != nil {
+		return
+	}
+
+	size := int(f.Length) - len(f.Src) - len(f.Dst) - 4
+	if size < 0 {
+		return errors.New("frame udp length not match.")
+	}
+	f.Data = make([]byte, size)
+	_, err = io.ReadFull(r, f.Data)
+	return
+}
+
+func (f *FrameUdp) Debug() string {
+	return fmt.Sprintf("frame udp: stream(%d), len(%d), src(%s), dst(%s).",
+		f.Streamid, f.Length, f.Src, f.Dst)
+}
+
 type FrameSender interface {
 	SendFrame(Frame) error
 	CloseFrame() error
@@ -70,6 +70,31 @@ func TestFrameAuthWrite(t *testing.T) {
 	}
 }
 
+func TestFrameAuthInfo(t *testing.T) {
+	f := NewFrameAuthInfo(10, "ab", "cd", "v1", "h")
+	buf, err := f.Packed()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if bytes.Compare(buf.Bytes(), []byte{MSG_AUTH, 0x00, 0x0F, 0x00, 0x0A,
+		0x00, 0x02, 0x61, 0x62, 0x00, 0x02, 0x63, 0x64,
+		0x00, 0x02, 0x76, 0x31, 0x00, 0x01, 0x68}) != 0 {
+		t.Fatalf("FrameAuth with info write wrong")
+	}
+
+	f1, err := ReadFrame(buf)
+	if err != nil {
+		t.Fatalf("Read FrameAuth with info failed")
+	}
+
+	ft, ok := f1.(*FrameAuth)
+	if !ok || ft.Username != "ab" || ft.Password != "cd" ||
+		ft.Version != "v1" || ft.Hostname != "h" {
+		t.Fatalf("FrameAuth with info body wrong")
+	}
+}
+
 func TestFrameDataRead(t *testing.T) {
 	buf := bytes.NewBuffer([]byte{MSG_DATA, 0x00, 0x03, 0x0A, 0x0A,
 		0x01, 0x05, 0x07})
@@ -244,6 +269,18 @@ func TestFramePingWrite(t *testing.T) {
 	}
 }
 
+func TestFramePongWrite(t *testing.T) {
+	f := NewFramePong()
+	buf, err := f.Packed()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if bytes.Compare(buf.Bytes(), []byte{MSG_PING, 0x00, 0x00, 0x00, 0x01}) != 0 {
+		t.Fatalf("FramePong write wrong")
+	}
+}
+
 func TestFrameDnsRead(t *testing.T) {
 	buf := bytes.NewBuffer([]byte{MSG_DNS, 0x00, 0x03, 0x0A, 0x0A,
 		0x01, 0x05, 0x07})
@@ -307,3 +344,103 @@ func TestFrameSpamWrite(t *testing.T) {
 		t.Fatalf("FrameSpam write wrong")
 	}
 }
+
+func TestFrameResultMsgRead(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{MSG_RESULT, 0x00, 0x08, 0x0A, 0x0A,
+		0x00, 0x00, 0x00, 0x07, 0x00, 0x02, 0x61, 0x62})
+
+	f, err := ReadFrame(buf)
+	if err != nil {
+		t.Fatalf("Read FrameResult failed")
+	}
+
+	ft, ok := f.(*FrameResult)
+	if !ok || ft.Streamid != 0x0a0a {
+		t.Fatalf("FrameResult format wrong")
+	}
+
+	if ft.Errno != ERR_REFUSED || ft.Message != "ab" {
+		t.Fatalf("FrameResult body wrong")
+	}
+}
+
+func TestFrameResultMsgWrite(t *testing.T) {
+	f := NewFrameResultMsg(10, ERR_REFUSED, "ab")
+	buf, err := f.Packed()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if bytes.Compare(buf.Bytes(), []byte{MSG_RESULT, 0x00, 0x08, 0x00, 0x0A,
+		0x00, 0x00, 0x00, 0x07, 0x00, 0x02, 0x61, 0x62}) != 0 {
+		t.Fatalf("FrameResult write wrong")
+	}
+}
+
+func TestFrameUdpRead(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{MSG_UDP, 0x00, 0x0B, 0x0A, 0x0A,
+		0x00, 0x02, 0x61, 0x62, 0x00, 0x02, 0x63, 0x64, 0x01, 0x05, 0x07})
+
+	f, err := ReadFrame(buf)
+	if err != nil {
+		t.Fatalf("Read FrameUdp failed")
+	}
+
+	ft, ok := f.(*FrameUdp)
+	if !ok || ft.Streamid != 0x0a0a {
+		t.Fatalf("FrameUdp format wrong")
+	}
+
+	if ft.Src != "ab" || ft.Dst != "cd" ||
+		bytes.Compare(ft.Data, []byte{0x01, 0x05, 0x07}) != 0 {
+		t.Fatalf("FrameUdp body wrong")
+	}
+}
+
+func TestFrameUdpWrite(t *testing.T) {
+	f, err := NewFrameUdp(10, "ab", "cd", []byte{0x01, 0x02, 0x03})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := f.Packed()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if bytes.Compare(buf.Bytes(), []byte{MSG_UDP, 0x00, 0x0B, 0x00, 0x0A,
+		0x00, 0x02, 0x61, 0x62, 0x00, 0x02, 0x63, 0x64, 0x01, 0x02, 0x03}) != 0 {
+		t.Fatalf("FrameUdp write wrong")
+	}
+}
+
+func TestFrameBindRead(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{MSG_BIND, 0x00, 0x08, 0x0A, 0x0A,
+		0x00, 0x02, 0x61, 0x62, 0x00, 0x02, 0x63, 0x64})
+
+	f, err := ReadFrame(buf)
+	if err != nil {
+		t.Fatalf("Read FrameBind failed")
+	}
+
+	ft, ok := f.(*FrameBind)
+	if !ok || ft.Streamid != 0x0a0a {
+		t.Fatalf("FrameBind format wrong")
+	}
+
+	if ft.Network != "ab" || ft.Address != "cd" {
+		t.Fatalf("FrameBind body wrong")
+	}
+}
+
+func TestFrameBindWrite(t *testing.T) {
+	f := NewFrameBind(10, "cd", "ab")
+	buf, err := f.Packed()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if bytes.Compare(buf.Bytes(), []byte{MSG_BIND, 0x00, 0x08, 0x00, 0x0A,
+		0x00, 0x02, 0x63, 0x64, 0x00, 0x02, 0x61, 0x62}) != 0 {
+		t.Fatalf("FrameBind write wrong")
+	}
+}
@@ -0,0 +1,248 @@
+package msocks
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Guard track auth failures by source ip. Each failure delays next
+// attempts from the ip progressively, and MaxFails failures in Window
+// ban the ip for BanTime. Records are bounded by MaxRecords.
+// Delayed attempts of one ip are serialized, see Enter.
+type Guard struct {
+	MaxFails   int
+	Window     time.Duration
+	BanTime    time.Duration
+	MaxDelay   time.Duration
+	MaxRecords int
+
+	lock    sync.Mutex
+	fails   map[string]*failRecord
+	bans    map[string]time.Time
+	waiting map[string]*waitQueue
+}
+
+type failRecord struct {
+	count int
+	last  time.Time
+}
+
+// waitQueue let delayed attempts of one ip take turns.
+type waitQueue struct {
+	turn chan struct{}
+	n    int
+}
+
+// Ban is an ip banned until time.
+type Ban struct {
+	IP    string
+	Until time.Time
+}
+
+func NewGuard() *Guard {
+	return &Guard{
+		MaxFails:   GUARD_FAILS,
+		Window:     GUARD_WINDOW * time.Second,
+		BanTime:    GUARD_BANTIME * time.Second,
+		MaxDelay:   GUARD_MAXDELAY * time.Second,
+		MaxRecords: GUARD_RECORDS,
+		fails:      make(map[string]*failRecord),
+		bans:       make(map[string]time.Time),
+		waiting:    make(map[string]*waitQueue),
+	}
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Allow return false if ip of addr is banned.
+func (g *Guard) Allow(addr net.Addr) bool {
+	ip := hostOf(addr)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	until, ok := g.bans[ip]
+	if !ok {
+		return true
+	}
+	if time.Now().Before(until) {
+		return false
+	}
+	delete(g.bans, ip)
+	return true
+}
+
+// Enter wait before an auth attempt of addr, return false if banned.
+// If addr failed recently, attempts wait in turn, each delayed by Delay,
+// so parallel connections try no faster than one by one. Only completed
+// failures count, attempts in progress never refuse each other, unless
+// more than GUARD_WAITERS are waiting.
+func (g *Guard) Enter(addr net.Addr) bool {
+	if !g.Allow(addr) {
+		return false
+	}
+	if g.Delay(addr) == 0 {
+		return true
+	}
+
+	ip := hostOf(addr)
+	g.lock.Lock()
+	q, ok := g.waiting[ip]
+	if !ok {
+		q = &waitQueue{turn: make(chan struct{}, 1)}
+		g.waiting[ip] = q
+	}
+	if q.n >= GUARD_WAITERS {
+		g.lock.Unlock()
+		log.Warningf("%s has %d auth waiting, refuse.", ip, q.n)
+		return false
+	}
+	q.n++
+	g.lock.Unlock()
+
+	q.turn <- struct{}{}
+	// failures may change while waiting.
+	if d := g.Delay(addr); d > 0 {
+		log.Infof("%s failed recently, delay %s.", ip, d)
+		time.Sleep(d)
+	}
+	<-q.turn
+
+	g.lock.Lock()
+	if q.n--; q.n == 0 {
+		delete(g.waiting, ip)
+	}
+	g.lock.Unlock()
+	return g.Allow(addr)
+}
+
+// Delay return how long to wait before auth of addr, doubled by
+// each failure in Window.
+func (g *Guard) Delay(addr net.Addr) time.Duration {
+	ip := hostOf(addr)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	r, ok := g.fails[ip]
+	if !ok || time.Since(r.last) > g.Window {
+		return 0
+	}
+	d := GUARD_DELAY * time.Millisecond
+	for i := 1; i < r.count && d < g.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > g.MaxDelay {
+		d = g.MaxDelay
+	}
+	return d
+}
+
+// Fail record a failure of addr, ban it if too many.
+func (g *Guard) Fail(addr net.Addr, err error) {
+	ip := hostOf(addr)
+	now := time.Now()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	r, ok := g.fails[ip]
+	if !ok || now.Sub(r.last) > g.Window {
+		if !ok && len(g.fails) >= g.MaxRecords {
+			g.evictFails(now)
+		}
+		r = &failRecord{}
+		g.fails[ip] = r
+	}
+	r.count++
+	r.last = now
+	log.Warningf("auth failed from %s (%d times): %s", ip, r.count, err)
+
+	if r.count < g.MaxFails {
+		return
+	}
+	delete(g.fails, ip)
+	if _, ok := g.bans[ip]; !ok && len(g.bans) >= g.MaxRecords {
+		g.evictBans(now)
+	}
+	g.bans[ip] = now.Add(g.BanTime)
+	log.Warningf("%s banned for %s.", ip, g.BanTime)
+}
+
+// Success forget failures of addr.
+func (g *Guard) Success(addr net.Addr) {
+	ip := hostOf(addr)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.fails, ip)
+}
+
+// remove expired records, or the oldest one if none expired.
+func (g *Guard) evictFails(now time.Time) {
+	var oldest string
+	for ip, r := range g.fails {
+		if now.Sub(r.last) > g.Window {
+			delete(g.fails, ip)
+			continue
+		}
+		if oldest == "" || r.last.Before(g.fails[oldest].last) {
+			oldest = ip
+		}
+	}
+	if len(g.fails) >= g.MaxRecords {
+		delete(g.fails, oldest)
+	}
+}
+
+// remove expired bans, or the one expire first if none expired.
+func (g *Guard) evictBans(now time.Time) {
+	var first string
+	for ip, until := range g.bans {
+		if now.After(until) {
+			delete(g.bans, ip)
+			continue
+		}
+		if first == "" || until.Before(g.bans[first]) {
+			first = ip
+		}
+	}
+	if len(g.bans) >= g.MaxRecords {
+		delete(g.bans, first)
+	}
+}
+
+// GetBans return ips banned now, sorted by ip.
+func (g *Guard) GetBans() (bans []Ban) {
+	now := time.Now()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for ip, until := range g.bans {
+		if now.Before(until) {
+			bans = append(bans, Ban{IP: ip, Until: until})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+	return
+}
+
+// Unban remove ban and failures of ip, empty ip for all.
+func (g *Guard) Unban(ip string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if ip == "" {
+		g.bans = make(map[string]time.Time)
+		g.fails = make(map[string]*failRecord)
+		log.Notice("all bans cleared.")
+		return
+	}
+	delete(g.bans, ip)
+	delete(g.fails, ip)
+	log.Noticef("%s unbanned.", ip)
+}
@@ -0,0 +1,147 @@
+package msocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+var errTestAuth = errors.New("auth failed")
+
+func testAddr(i int) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(fmt.Sprintf("192.0.2.%d", i)), Port: 1000 + i}
+}
+
+func TestGuardBan(t *testing.T) {
+	g := NewGuard()
+	g.MaxFails = 3
+	addr := testAddr(1)
+
+	for i := 0; i < 2; i++ {
+		g.Fail(addr, errTestAuth)
+	}
+	if !g.Allow(addr) {
+		t.Fatalf("banned before threshold")
+	}
+	if g.Delay(addr) == 0 {
+		t.Fatalf("failures should delay next attempt")
+	}
+	g.Fail(addr, errTestAuth)
+	if g.Allow(addr) {
+		t.Fatalf("not banned after threshold")
+	}
+	if bans := g.GetBans(); len(bans) != 1 || bans[0].IP != "192.0.2.1" {
+		t.Fatalf("bans wrong: %v", bans)
+	}
+	// other port of the same ip is banned too.
+	if g.Allow(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}) {
+		t.Fatalf("ban should be by ip")
+	}
+
+	g.Unban("192.0.2.1")
+	if !g.Allow(addr) || g.Delay(addr) != 0 {
+		t.Fatalf("unban should clear ban and failures")
+	}
+}
+
+func TestGuardWindow(t *testing.T) {
+	g := NewGuard()
+	g.MaxFails = 3
+	g.Window = 20 * time.Millisecond
+	g.BanTime = 20 * time.Millisecond
+	addr := testAddr(1)
+
+	g.Fail(addr, errTestAuth)
+	g.Fail(addr, errTestAuth)
+	time.Sleep(30 * time.Millisecond)
+	if g.Delay(addr) != 0 {
+		t.Fatalf("failures out of window should not delay")
+	}
+	// count restarted, not banned.
+	g.Fail(addr, errTestAuth)
+	if !g.Allow(addr) {
+		t.Fatalf("failures out of window should not count")
+	}
+
+	g.Fail(addr, errTestAuth)
+	g.Fail(addr, errTestAuth)
+	if g.Allow(addr) {
+		t.Fatalf("not banned after threshold")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !g.Allow(addr) {
+		t.Fatalf("ban should expire")
+	}
+}
+
+func TestGuardEviction(t *testing.T) {
+	g := NewGuard()
+	g.MaxRecords = 2
+
+	for i := 1; i <= 3; i++ {
+		g.Fail(testAddr(i), errTestAuth)
+	}
+	if len(g.fails) != 2 {
+		t.Fatalf("failure records not bounded: %d", len(g.fails))
+	}
+	if _, ok := g.fails["192.0.2.1"]; ok {
+		t.Fatalf("oldest failure record should be evicted")
+	}
+
+	g.MaxFails = 1
+	for i := 1; i <= 3; i++ {
+		g.Fail(testAddr(i), errTestAuth)
+	}
+	if len(g.bans) != 2 {
+		t.Fatalf("bans not bounded: %d", len(g.bans))
+	}
+	if !g.Allow(testAddr(1)) {
+		t.Fatalf("ban expire first should be evicted")
+	}
+}
+
+func TestGuardSerialize(t *testing.T) {
+	g := NewGuard()
+	g.MaxFails = 3
+	g.MaxDelay = 50 * time.Millisecond
+	addr := testAddr(1)
+
+	// attempts in progress never count as failures.
+	for i := 0; i < 5; i++ {
+		if !g.Enter(addr) {
+			t.Fatalf("attempt %d refused", i)
+		}
+	}
+
+	// after failure, parallel attempts wait in turn, none refused.
+	g.Fail(addr, errTestAuth)
+	start := time.Now()
+	done := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- g.Enter(addr)
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if !<-done {
+			t.Fatalf("parallel attempt after failure refused")
+		}
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("delayed attempts not serialized: %s", d)
+	}
+	if !g.Enter(testAddr(2)) {
+		t.Fatalf("other ip should not be affected")
+	}
+
+	g.Fail(addr, errTestAuth)
+	g.Fail(addr, errTestAuth)
+	if g.Enter(addr) {
+		t.Fatalf("banned ip entered")
+	}
+	if len(g.waiting) != 0 {
+		t.Fatalf("wait queues not cleaned: %d", len(g.waiting))
+	}
+}
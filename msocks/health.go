@@ -0,0 +1,163 @@
+package msocks
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServerHealth keep track of one server, for choosing server and session.
+// Latency is handshake time of session, RTT is measured by ping in session.
+// Both are moving average. ErrRate is moving average of failures, in 0-1.
+// After BREAKER_THRESHOLD continuous connect failures, the server will be
+// skipped for a while (circuit open), the time doubled for each failure,
+// up to BREAKER_MAX seconds.
+type ServerHealth struct {
+	lock      sync.Mutex
+	Latency   time.Duration
+	RTT       time.Duration
+	ErrRate   float64
+	Fails     int
+	Success   uint64
+	Failure   uint64
+	OpenUntil time.Time
+}
+
+func ewma(avg, v time.Duration) time.Duration {
+	if avg == 0 {
+		return v
+	}
+	return (avg*7 + v) / 8
+}
+
+func (h *ServerHealth) RecordSuccess(latency time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.Latency = ewma(h.Latency, latency)
+	h.ErrRate *= 0.8
+	h.Fails = 0
+	h.Success++
+	h.OpenUntil = time.Time{}
+}
+
+// RecordFailure for connect or handshake failed.
+func (h *ServerHealth) RecordFailure() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.ErrRate = h.ErrRate*0.8 + 0.2
+	h.Fails++
+	h.Failure++
+
+	if h.Fails >= BREAKER_THRESHOLD {
+		backoff := BREAKER_BASE * time.Second << uint(h.Fails-BREAKER_THRESHOLD)
+		if backoff > BREAKER_MAX*time.Second || backoff <= 0 {
+			backoff = BREAKER_MAX * time.Second
+		}
+		h.OpenUntil = time.Now().Add(backoff)
+	}
+}
+
+// RecordError for failures in a live session, like syn timeout.
+// It counts in score, but will not open the circuit.
+func (h *ServerHealth) RecordError() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.ErrRate = h.ErrRate*0.8 + 0.2
+}
+
+func (h *ServerHealth) RecordRTT(rtt time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.RTT = ewma(h.RTT, rtt)
+}
+
+// Allow return false if circuit is open.
+func (h *ServerHealth) Allow() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return time.Now().After(h.OpenUntil)
+}
+
+func (h *ServerHealth) RetryAt() time.Time {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.OpenUntil
+}
+
+// Score is an estimate of delay in ms, lower is better.
+// Circuit open gets +Inf. Server never tried gets 0, so it will be tried.
+func (h *ServerHealth) Score() float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if time.Now().Before(h.OpenUntil) {
+		return math.Inf(1)
+	}
+	base := h.RTT
+	if base == 0 {
+		base = h.Latency
+	}
+	return float64(base) / float64(time.Millisecond) * (1 + 4*h.ErrRate)
+}
+
+func (h *ServerHealth) State() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if time.Now().Before(h.OpenUntil) {
+		return fmt.Sprintf("open until %s", h.OpenUntil.Format("15:04:05"))
+	}
+	return "ok"
+}
+
+func (h *ServerHealth) String() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return fmt.Sprintf("latency: %s, rtt: %s, errrate: %.2f, success: %d, failure: %d",
+		h.Latency, h.RTT, h.ErrRate, h.Success, h.Failure)
+}
+
+// ---- ping part ----
+
+// Ping send a ping to remote, the rtt will be updated when pong come back.
+// Remote which don't know pong will just ignore it.
+func (s *Session) Ping() (err error) {
+	atomic.StoreInt64(&s.pingsent, time.Now().UnixNano())
+	return s.SendFrame(NewFramePing())
+}
+
+func (s *Session) on_ping(ft *FramePing) (err error) {
+	if ft.Streamid == 0 {
+		return s.SendFrame(NewFramePong())
+	}
+
+	sent := atomic.SwapInt64(&s.pingsent, 0)
+	if sent == 0 {
+		return
+	}
+	rtt := time.Duration(time.Now().UnixNano() - sent)
+	atomic.StoreInt64(&s.rtt, int64(ewma(s.GetRTT(), rtt)))
+	if s.health != nil {
+		s.health.RecordRTT(rtt)
+	}
+	log.Debugf("%s rtt: %s.", s.String(), rtt)
+	return
+}
+
+func (s *Session) GetRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
+
+// pinger keep pinging until session closed.
+func (s *Session) pinger() {
+	ticker := time.NewTicker(PING_INTERVAL * time.Second)
+	defer ticker.Stop()
+	for !s.IsClosed() {
+		err := s.Ping()
+		if err != nil {
+			log.Errorf("%s", err)
+			return
+		}
+		<-ticker.C
+	}
+}
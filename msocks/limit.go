@@ -0,0 +1,340 @@
+package msocks
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limit is bandwidth, traffic and concurrency limit of one user in server.
+// Upload and Download are rates in bytes per second, Daily and Monthly
+// are quotas in bytes. Sessions and Streams limit concurrent sessions and
+// streams, StreamRate limit new streams per second. Zero means unlimited.
+type Limit struct {
+	Upload   int64
+	Download int64
+	Daily    int64
+	Monthly  int64
+
+	Sessions   int
+	Streams    int
+	StreamRate int64
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill tokens by rate, burst is one second of rate.
+func (b *bucket) refill(rate int64, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	}
+	b.last = now
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+}
+
+// reserve n bytes with rate, return how long should wait.
+func (b *bucket) reserve(rate int64, n int, now time.Time) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	b.refill(rate, now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// take one token if there is, never wait.
+func (b *bucket) take(rate int64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	b.refill(rate, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Usage is traffic and concurrency of one user, shared by all sessions
+// of the user.
+type Usage struct {
+	lock  sync.Mutex
+	limit *Limit
+	up    bucket
+	down  bucket
+	syns  bucket
+
+	// nsess count sessions authed, include those not running yet.
+	nsess    int
+	sessions map[*Session]struct{}
+
+	day     string
+	month   string
+	Daily   int64
+	Monthly int64
+}
+
+func NewUsage(limit *Limit) *Usage {
+	return &Usage{limit: limit, sessions: make(map[*Session]struct{})}
+}
+
+// acquire a session slot in auth, false if too many sessions.
+func (u *Usage) acquire() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.limit.Sessions > 0 && u.nsess >= u.limit.Sessions {
+		return false
+	}
+	u.nsess++
+	return true
+}
+
+func (u *Usage) release() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.nsess--
+}
+
+func (u *Usage) attach(s *Session) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.sessions[s] = struct{}{}
+}
+
+func (u *Usage) detach(s *Session) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.sessions, s)
+}
+
+// checkSyn return reason if a new stream should be refused.
+func (u *Usage) checkSyn() string {
+	u.lock.Lock()
+	if !u.syns.take(u.limit.StreamRate, time.Now()) {
+		u.lock.Unlock()
+		return "too many new streams"
+	}
+	if u.limit.Streams <= 0 {
+		u.lock.Unlock()
+		return ""
+	}
+	sessions := make([]*Session, 0, len(u.sessions))
+	for s := range u.sessions {
+		sessions = append(sessions, s)
+	}
+	u.lock.Unlock()
+
+	n := 0
+	for _, s := range sessions {
+		n += s.GetStreams()
+	}
+	if n >= u.limit.Streams {
+		return "too many streams"
+	}
+	return ""
+}
+
+// roll reset counters when day or month changed. Called with lock held.
+func (u *Usage) roll(now time.Time) {
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	if u.day != day {
+		u.day, u.Daily = day, 0
+	}
+	if u.month != month {
+		u.month, u.Monthly = month, 0
+	}
+}
+
+func (u *Usage) exceeded() bool {
+	return (u.limit.Daily > 0 && u.Daily >= u.limit.Daily) ||
+		(u.limit.Monthly > 0 && u.Monthly >= u.limit.Monthly)
+}
+
+// Exceeded tell if user used up daily or monthly quota.
+func (u *Usage) Exceeded() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.roll(time.Now())
+	return u.exceeded()
+}
+
+// Wait count n bytes in upload or download, and sleep to keep rate.
+// If quota exceeded, rate will be throttled to QUOTA_RATE.
+func (u *Usage) Wait(upload bool, n int) {
+	if n <= 0 {
+		return
+	}
+	now := time.Now()
+
+	u.lock.Lock()
+	u.roll(now)
+	u.Daily += int64(n)
+	u.Monthly += int64(n)
+
+	rate, b := u.limit.Download, &u.down
+	if upload {
+		rate, b = u.limit.Upload, &u.up
+	}
+	if u.exceeded() && (rate <= 0 || rate > QUOTA_RATE) {
+		rate = QUOTA_RATE
+	}
+	d := b.reserve(rate, n, now)
+	u.lock.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (u *Usage) String() string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.roll(time.Now())
+	s := fmt.Sprintf("today %d, month %d", u.Daily, u.Monthly)
+	if u.exceeded() {
+		s += ", over quota"
+	}
+	return s
+}
+
+// traffic count n bytes to address in server, for quota and accounting.
+// It may sleep to keep rate limit.
+func (s *Session) traffic(address string, upload bool, n int) {
+	if s.server == nil || n <= 0 {
+		return
+	}
+	if a := s.server.Accounting; a != nil {
+		if upload {
+			a.Add(s.Username, address, n, 0)
+		} else {
+			a.Add(s.Username, address, 0, n)
+		}
+	}
+	if s.usage != nil {
+		s.usage.Wait(upload, n)
+	}
+}
+
+// SetLimits set limits by username, "*" for users not listed.
+func (ms *MsocksServer) SetLimits(limits map[string]*Limit) {
+	ms.ulock.Lock()
+	defer ms.ulock.Unlock()
+	ms.limits = limits
+	ms.usages = make(map[string]*Usage)
+}
+
+// getUsage return usage of user, nil if user has no limit.
+func (ms *MsocksServer) getUsage(username string) *Usage {
+	ms.ulock.Lock()
+	defer ms.ulock.Unlock()
+	return ms.usageOf(username)
+}
+
+// acquireUsage get usage of user and a session slot in it, false if too
+// many sessions. Usage with session will never be evicted.
+func (ms *MsocksServer) acquireUsage(username string) (u *Usage, ok bool) {
+	ms.ulock.Lock()
+	defer ms.ulock.Unlock()
+	u = ms.usageOf(username)
+	if u == nil {
+		return nil, true
+	}
+	return u, u.acquire()
+}
+
+// usageOf return usage of user, create it if not exist. Called with
+// ulock held.
+func (ms *MsocksServer) usageOf(username string) *Usage {
+	if u, ok := ms.usages[username]; ok {
+		return u
+	}
+	limit, ok := ms.limits[username]
+	if !ok {
+		limit = ms.limits["*"]
+	}
+	if limit == nil {
+		return nil
+	}
+	if len(ms.usages) >= USAGE_MAX {
+		ms.evictUsages()
+	}
+	u := NewUsage(limit)
+	ms.usages[username] = u
+	return u
+}
+
+// evictUsages forget users without session, users not listed in limits
+// first, so usernames from clients without auth will not use up memory.
+// Traffic counted of users evicted is lost. Called with ulock held.
+func (ms *MsocksServer) evictUsages() {
+	for _, listed := range []bool{false, true} {
+		for username, u := range ms.usages {
+			if len(ms.usages) < USAGE_MAX {
+				return
+			}
+			if _, ok := ms.limits[username]; ok != listed {
+				continue
+			}
+			u.lock.Lock()
+			idle := u.nsess == 0
+			u.lock.Unlock()
+			if idle {
+				delete(ms.usages, username)
+			}
+		}
+	}
+}
+
+// UserStat is current usage of one user, for admin.
+type UserStat struct {
+	Username string
+	Sessions int
+	Streams  int
+	Usage    *Usage
+}
+
+// GetUserStats return stats of users online or ever limited.
+func (ms *MsocksServer) GetUserStats() (stats []*UserStat) {
+	m := make(map[string]*UserStat)
+	get := func(username string) *UserStat {
+		st, ok := m[username]
+		if !ok {
+			st = &UserStat{Username: username}
+			m[username] = st
+		}
+		return st
+	}
+
+	ms.ulock.Lock()
+	for username, u := range ms.usages {
+		get(username).Usage = u
+	}
+	ms.ulock.Unlock()
+
+	ms.mu.Lock()
+	for s := range ms.sess {
+		st := get(s.Username)
+		st.Sessions++
+		st.Streams += s.GetStreams()
+	}
+	ms.mu.Unlock()
+
+	for _, st := range m {
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Username < stats[j].Username
+	})
+	return
+}
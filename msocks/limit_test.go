@@ -0,0 +1,130 @@
+package msocks
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBucketReserve(t *testing.T) {
+	var b bucket
+	now := time.Now()
+	if d := b.reserve(0, 1000, now); d != 0 {
+		t.Fatalf("unlimited should never wait")
+	}
+	// burst is one second of rate.
+	if d := b.reserve(1000, 1000, now); d != 0 {
+		t.Fatalf("burst should not wait, got %s", d)
+	}
+	if d := b.reserve(1000, 500, now); d != 500*time.Millisecond {
+		t.Fatalf("should wait 500ms, got %s", d)
+	}
+	// refilled 1000 after one second, 500 owed.
+	if d := b.reserve(1000, 500, now.Add(time.Second)); d != 0 {
+		t.Fatalf("refilled bucket should not wait, got %s", d)
+	}
+}
+
+func TestUsageQuotaRollover(t *testing.T) {
+	u := NewUsage(&Limit{Daily: 100, Monthly: 150})
+	u.Wait(true, 60)
+	u.Wait(false, 40)
+	if !u.Exceeded() {
+		t.Fatalf("daily quota should be exceeded")
+	}
+
+	// next day, daily reset but monthly kept.
+	u.lock.Lock()
+	u.day = "2000-01-01"
+	u.lock.Unlock()
+	if u.Exceeded() {
+		t.Fatalf("daily quota should be reset in new day")
+	}
+	u.Wait(true, 50)
+	if !u.Exceeded() {
+		t.Fatalf("monthly quota should be exceeded")
+	}
+
+	// next month, both reset.
+	u.lock.Lock()
+	u.day, u.month = "2000-01-01", "2000-01"
+	u.lock.Unlock()
+	if u.Exceeded() || u.Daily != 0 || u.Monthly != 0 {
+		t.Fatalf("quota should be reset in new month")
+	}
+}
+
+func TestUsageSessions(t *testing.T) {
+	u := NewUsage(&Limit{Sessions: 1})
+	if !u.acquire() {
+		t.Fatalf("first session should be allowed")
+	}
+	if u.acquire() {
+		t.Fatalf("session over limit should be refused")
+	}
+	u.release()
+	if !u.acquire() {
+		t.Fatalf("session should be allowed after released")
+	}
+}
+
+func TestUsageCheckSyn(t *testing.T) {
+	u := NewUsage(&Limit{StreamRate: 2})
+	for i := 0; i < 2; i++ {
+		if reason := u.checkSyn(); reason != "" {
+			t.Fatalf("syn in rate refused: %s", reason)
+		}
+	}
+	if u.checkSyn() == "" {
+		t.Fatalf("syn over rate should be refused")
+	}
+
+	u = NewUsage(&Limit{Streams: 2})
+	c1, _ := net.Pipe()
+	s := NewSession(c1)
+	u.attach(s)
+	for i := uint16(1); i <= 2; i++ {
+		if reason := u.checkSyn(); reason != "" {
+			t.Fatalf("syn under limit refused: %s", reason)
+		}
+		s.PutIntoId(i, NewConn(ST_EST, i, s, "tcp", "example.com:80"))
+	}
+	if u.checkSyn() == "" {
+		t.Fatalf("syn over streams limit should be refused")
+	}
+
+	u.detach(s)
+	if reason := u.checkSyn(); reason != "" {
+		t.Fatalf("streams of detached session still counted: %s", reason)
+	}
+}
+
+func TestUsageEvict(t *testing.T) {
+	ms := &MsocksServer{}
+	ms.SetLimits(map[string]*Limit{
+		"*":     {Sessions: 1},
+		"alice": {Daily: 1024},
+	})
+
+	alice := ms.getUsage("alice")
+	busy, ok := ms.acquireUsage("busy")
+	if !ok {
+		t.Fatalf("acquireUsage failed")
+	}
+	for i := 0; i < USAGE_MAX*2; i++ {
+		ms.getUsage(fmt.Sprintf("user%d", i))
+	}
+	if len(ms.usages) > USAGE_MAX {
+		t.Fatalf("usages not bounded: %d", len(ms.usages))
+	}
+	if ms.getUsage("busy") != busy {
+		t.Fatalf("usage with session should not be evicted")
+	}
+	if ms.getUsage("alice") != alice {
+		t.Fatalf("users listed should be evicted last")
+	}
+	if _, ok = ms.acquireUsage("busy"); ok {
+		t.Fatalf("session over limit should be refused")
+	}
+}
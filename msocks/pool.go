@@ -1,12 +1,19 @@
 package msocks
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/shell909090/goproxy/sutils"
 )
 
@@ -15,10 +22,30 @@ type SessionFactory struct {
 	serveraddr string
 	username   string
 	password   string
+	Health     ServerHealth
+	// lower priority will be used first, Group is just a name of them.
+	Group    string
+	Priority int
+	// Class limit server to one class of sessions, empty for all.
+	Class string
+}
+
+func (sf *SessionFactory) String() string {
+	return sf.serveraddr
 }
 
 func (sf *SessionFactory) CreateSession() (s *Session, err error) {
 	log.Noticef("msocks try to connect %s.", sf.serveraddr)
+	start := time.Now()
+	defer func() {
+		if err != nil {
+			sf.Health.RecordFailure()
+			return
+		}
+		sf.Health.RecordSuccess(time.Since(start))
+		s.health = &sf.Health
+		s.priority = sf.Priority
+	}()
 
 	conn, err := sf.Dialer.Dial("tcp", sf.serveraddr)
 	if err != nil {
@@ -34,7 +61,10 @@ func (sf *SessionFactory) CreateSession() (s *Session, err error) {
 	}()
 
 	log.Noticef("auth with username: %s, password: %s.", sf.username, sf.password)
-	fb := NewFrameAuth(0, sf.username, sf.password)
+	fb := NewFrameAuth(CAP_RESULTMSG, sf.username, sf.password)
+	if ClientVersion != "" {
+		fb = NewFrameAuthInfo(CAP_RESULTMSG, sf.username, sf.password, ClientVersion, ClientHostname)
+	}
 	buf, err := fb.Packed()
 	if err != nil {
 		return
@@ -57,22 +87,60 @@ func (sf *SessionFactory) CreateSession() (s *Session, err error) {
 
 	if ft.Errno != ERR_NONE {
 		conn.Close()
-		return nil, fmt.Errorf("create connection failed with code: %d.", ft.Errno)
+		return nil, fmt.Errorf("create connection failed: %s %s.", ErrnoText(ft.Errno), ft.Message)
 	}
 
 	log.Notice("auth passwd.")
 	s = NewSession(conn)
+	s.Username = sf.username
+	s.Server = sf.serveraddr
+	s.resultmsg = true
+	s.datagram = ft.Streamid&CAP_DATAGRAM != 0
 	// s.pong()
 	return
 }
 
 type SessionPool struct {
-	mu      sync.Mutex // sess pool locker
-	muf     sync.Mutex // factory locker
-	sess    map[*Session]struct{}
-	asfs    []*SessionFactory
-	MinSess int
-	MaxConn int
+	mu       sync.Mutex // sess pool locker
+	muf      sync.Mutex // factory locker
+	sess     map[*Session]struct{}
+	asfs     []*SessionFactory
+	MinSess  int
+	MaxConn  int
+	FastOpen bool
+
+	// MaxSess limit sessions created for load, 0 means no limit.
+	// Idle sessions more than MinSess will be closed after IdleTimeout.
+	// Sessions older than MaxAge will be rotated: no new streams, and
+	// closed after drained. 0 means never.
+	MaxSess     int
+	IdleTimeout time.Duration
+	MaxAge      time.Duration
+	reaperOnce  sync.Once
+	closing     bool
+	// closed in Shutdown, to stop reaper.
+	stop chan struct{}
+
+	// only one try to connect better servers at a time, see tryBetter.
+	bettering  int32
+	betternext int64
+
+	// DialRetry is how many times a failed syn will be tried again in
+	// another session. Only session failures (timeout, session closed)
+	// will be retried, unless RetryAll set, then target failures too.
+	DialRetry int
+	RetryAll  bool
+
+	// streams classified as bulk go to bulk sessions, see class.go.
+	BulkMinSess   int
+	BulkMaxConn   int
+	BulkThreshold int64
+	bulkrules     []string
+	bulklock      sync.Mutex
+	bulkhosts     map[string]time.Time
+
+	budget        *MemBudget
+	MaxSessBuffer int64
 }
 
 func CreateSessionPool(MinSess, MaxConn int) (sp *SessionPool) {
@@ -83,15 +151,37 @@ func CreateSessionPool(MinSess, MaxConn int) (sp *SessionPool) {
 		MaxConn = 16
 	}
 	sp = &SessionPool{
-		sess:    make(map[*Session]struct{}, 0),
-		MinSess: MinSess,
-		MaxConn: MaxConn,
+		sess:        make(map[*Session]struct{}, 0),
+		MinSess:     MinSess,
+		MaxConn:     MaxConn,
+		DialRetry:   STREAM_RETRY,
+		BulkMaxConn: BULK_MAXCONN,
+		bulkhosts:   make(map[string]time.Time, 0),
+		budget:      NewMemBudget(0, nil),
+		stop:        make(chan struct{}),
 	}
 	return
 }
 
-func (sp *SessionPool) AddSessionFactory(dialer sutils.Dialer, serveraddr, username, password string) {
-	sf := &SessionFactory{
+// SetBufferLimit set limit of buffered data for whole pool and each session,
+// 0 for no limit (default). Stream exceeding limit will be reset, so limit
+// should be larger than WINDOWSIZE times streams expected.
+// Only sessions added after this call will be affected.
+func (sp *SessionPool) SetBufferLimit(limit, sesslimit int64) {
+	sp.budget.Limit = limit
+	sp.MaxSessBuffer = sesslimit
+}
+
+func (sp *SessionPool) GetBuffered() int64 {
+	return sp.budget.GetUsed()
+}
+
+func (sp *SessionPool) GetBufferLimit() int64 {
+	return sp.budget.Limit
+}
+
+func (sp *SessionPool) AddSessionFactory(dialer sutils.Dialer, serveraddr, username, password string) (sf *SessionFactory) {
+	sf = &SessionFactory{
 		Dialer:     dialer,
 		serveraddr: serveraddr,
 		username:   username,
@@ -101,6 +191,7 @@ func (sp *SessionPool) AddSessionFactory(dialer sutils.Dialer, serveraddr, usern
 	sp.muf.Lock()
 	defer sp.muf.Unlock()
 	sp.asfs = append(sp.asfs, sf)
+	return
 }
 
 func (sp *SessionPool) CutAll() {
@@ -120,10 +211,22 @@ func (sp *SessionPool) GetSessions() (sess map[*Session]struct{}) {
 	return sp.sess
 }
 
-func (sp *SessionPool) Add(s *Session) {
+// Add should be called before session run, buffer budget will be replaced.
+// Return ErrShutdown if pool is shutting down, session should be closed.
+func (sp *SessionPool) Add(s *Session) (err error) {
+	s.budget = NewMemBudget(sp.MaxSessBuffer, sp.budget)
+	if sp.BulkThreshold != 0 {
+		s.bulkThreshold = sp.BulkThreshold
+		s.onBulk = sp.markBulk
+	}
 	sp.mu.Lock()
 	defer sp.mu.Unlock()
+	// checked under lock, so Shutdown will not miss it.
+	if sp.closing {
+		return ErrShutdown
+	}
 	sp.sess[s] = struct{}{}
+	return
 }
 
 func (sp *SessionPool) Remove(s *Session) (err error) {
@@ -137,77 +240,250 @@ func (sp *SessionPool) Remove(s *Session) (err error) {
 }
 
 func (sp *SessionPool) Get() (sess *Session, err error) {
-	if len(sp.sess) == 0 {
+	return sp.get(CLASS_INTERACTIVE, nil)
+}
+
+// classSize return MinSess and MaxConn of class.
+func (sp *SessionPool) classSize(class string) (minsess, maxconn int) {
+	if class == CLASS_BULK {
+		return sp.BulkMinSess, sp.BulkMaxConn
+	}
+	return sp.MinSess, sp.MaxConn
+}
+
+// get select a session of class not in exclude, create one if none left.
+func (sp *SessionPool) get(class string, exclude map[*Session]struct{}) (sess *Session, err error) {
+	if sp.IsClosing() {
+		return nil, ErrShutdown
+	}
+	minsess, maxconn := sp.classSize(class)
+
+	sess, _ = sp.getLessSess(class, exclude)
+	if sess == nil {
 		err = sp.createSession(func() bool {
-			return len(sp.sess) == 0
-		})
+			s, _ := sp.getLessSess(class, exclude)
+			// retry should not create sessions more than MaxSess.
+			return s == nil && (len(exclude) == 0 || !sp.full())
+		}, class)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	sess, size := sp.getLessSess()
+	sess, size := sp.getLessSess(class, exclude)
 	if sess == nil {
 		return nil, ErrNoSession
 	}
 
-	if size > sp.MaxConn || len(sp.sess) < sp.MinSess {
+	if sp.countAlive(class) < minsess || ((size > maxconn || sess.IsSuspect()) && !sp.full()) {
 		go sp.createSession(func() bool {
-			if len(sp.sess) < sp.MinSess {
+			if sp.countAlive(class) < minsess {
 				return true
 			}
-			// normally, size == -1 should never happen
-			_, size := sp.getLessSess()
-			return size > sp.MaxConn
-		})
+			if sp.full() {
+				return false
+			}
+			// normally, s == nil should never happen
+			s, size := sp.getLessSess(class, nil)
+			return s == nil || s.IsSuspect() || size > maxconn
+		}, class)
+	}
+
+	if sess.IsSuspect() {
+		return
 	}
+	if sp.betterAllowed(sess.priority, class) {
+		sp.tryBetter(sess.priority, class)
+	}
+	sp.drain(sess.priority, class)
 	return
 }
 
-// Randomly select a server, try to connect with it. If it is failed, try next.
+// tryBetter connect servers better than prio in background, when they
+// come back. Only one try at a time, at most once in BETTER_INTERVAL.
+func (sp *SessionPool) tryBetter(prio int, class string) {
+	now := time.Now().UnixNano()
+	if now < atomic.LoadInt64(&sp.betternext) {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&sp.bettering, 0, 1) {
+		return
+	}
+	atomic.StoreInt64(&sp.betternext, now+int64(BETTER_INTERVAL*time.Second))
+
+	go func() {
+		defer atomic.StoreInt32(&sp.bettering, 0)
+		sp.createSessionBelow(func() bool {
+			s, _ := sp.getLessSess(class, nil)
+			return s != nil && sp.betterAllowed(s.priority, class)
+		}, prio, class)
+	}()
+}
+
+// countAlive return number of sessions not rotating, in class or all if
+// class is empty.
+func (sp *SessionPool) countAlive(class string) (n int) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for s, _ := range sp.sess {
+		if !s.IsRotating() && (class == "" || s.Class == class) {
+			n++
+		}
+	}
+	return
+}
+
+func (sp *SessionPool) full() bool {
+	return sp.MaxSess != 0 && sp.countAlive("") >= sp.MaxSess
+}
+
+// betterAllowed tell if any server with priority lower than prio can be used.
+func (sp *SessionPool) betterAllowed(prio int, class string) bool {
+	for _, asf := range sp.asfs {
+		if asf.Priority < prio && asf.serve(class) && asf.Health.Allow() {
+			return true
+		}
+	}
+	return false
+}
+
+// drain rotate idle sessions with worse priority, since they will not
+// get new streams anymore. Reaper will close them after DRAIN_GRACE, a
+// stream may be putting into it just now.
+func (sp *SessionPool) drain(prio int, class string) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for s, _ := range sp.sess {
+		if s.Class == class && s.priority > prio && !s.IsRotating() && s.GetSize() == 0 {
+			log.Noticef("%s is backup and idle, drain it.", s.String())
+			s.Rotate()
+		}
+	}
+}
+
+// Select servers by score, try to connect with it. If it is failed, try next.
 // Repeat for DIAL_RETRY times.
 // Each time it will take 2 ^ (net.ipv4.tcp_syn_retries + 1) - 1 second(s).
 // eg. net.ipv4.tcp_syn_retries = 4, connect will timeout in 2 ^ (4 + 1) -1 = 31s.
-func (sp *SessionPool) createSession(checker func() bool) (err error) {
+func (sp *SessionPool) createSession(checker func() bool, class string) (err error) {
+	return sp.createSessionBelow(checker, math.MaxInt32, class)
+}
+
+// createSessionBelow only try servers with priority lower than prio.
+func (sp *SessionPool) createSessionBelow(checker func() bool, prio int, class string) (err error) {
 	sp.muf.Lock()
 	defer sp.muf.Unlock()
 
 	if checker != nil && !checker() {
 		return
 	}
+	if sp.IsClosing() {
+		return ErrShutdown
+	}
 
 	var sess *Session
+	err = ErrNoServer
+
+	for i := 0; i < DIAL_RETRY && err != nil; i++ {
+		for _, asf := range sp.orderFactories(prio, class, prio == math.MaxInt32) {
+			sess, err = asf.CreateSession()
+			if err != nil {
+				log.Errorf("%s", err)
+				continue
+			}
+			break
+		}
+	}
 
-	start := rand.Int()
-	end := start + DIAL_RETRY*len(sp.asfs)
-	for i := start; i < end; i++ {
-		asf := sp.asfs[i%len(sp.asfs)]
-		sess, err = asf.CreateSession()
-		if err != nil {
-			log.Errorf("%s", err)
-			continue
+	if err != nil {
+		if prio == math.MaxInt32 {
+			log.Critical("can't connect to any server, quit.")
+		} else {
+			log.Warning("can't connect to any better server.")
 		}
-		break
+		return ErrNoServer
 	}
+	sess.Class = class
+	log.Noticef("session %s created, class: %s.", sess.String(), class)
 
+	err = sp.Add(sess)
 	if err != nil {
-		log.Critical("can't connect to any server, quit.")
+		sess.Close()
 		return
 	}
-	log.Notice("session created.")
-
-	sp.Add(sess)
 	go sp.sessRun(sess)
 	return
 }
 
-func (sp *SessionPool) getLessSess() (sess *Session, size int) {
+// orderFactories return servers below prio and can serve class,
+// sorted by priority and score.
+// Servers with circuit open are skipped, so backup servers will be tried
+// right after all primary servers failed. If all are open and fallback
+// set, the one will be closed first returned.
+func (sp *SessionPool) orderFactories(prio int, class string, fallback bool) (asfs []*SessionFactory) {
+	var next *SessionFactory
+	for _, i := range rand.Perm(len(sp.asfs)) {
+		asf := sp.asfs[i]
+		if asf.Priority >= prio || !asf.serve(class) {
+			continue
+		}
+		if asf.Health.Allow() {
+			asfs = append(asfs, asf)
+			continue
+		}
+		if next == nil || asf.Health.RetryAt().Before(next.Health.RetryAt()) {
+			next = asf
+		}
+	}
+
+	if len(asfs) == 0 && next != nil && fallback {
+		log.Warningf("all servers failed, try %s.", next.String())
+		return []*SessionFactory{next}
+	}
+	// random first, so servers with same score are balanced.
+	sort.SliceStable(asfs, func(i, j int) bool {
+		if asfs[i].Priority != asfs[j].Priority {
+			return asfs[i].Priority < asfs[j].Priority
+		}
+		return asfs[i].Health.Score() < asfs[j].Health.Score()
+	})
+	return
+}
+
+func (sp *SessionPool) GetFactories() []*SessionFactory {
+	return sp.asfs
+}
+
+// sessCost estimate delay of a new stream in this session.
+// Each stream counts as RTT, plus RTT_BASE ms, so idle session with
+// a little higher RTT may still be chosen.
+func sessCost(s *Session) time.Duration {
+	return time.Duration(s.GetSize()+1) * (s.GetRTT() + RTT_BASE*time.Millisecond)
+}
+
+// getLessSess return the session with lowest cost,
+// not suspect first, then lower priority.
+func (sp *SessionPool) getLessSess(class string, exclude map[*Session]struct{}) (sess *Session, size int) {
 	size = -1
 	for s, _ := range sp.sess {
-		if size == -1 || s.GetSize() < size {
-			sess = s
-			size = s.GetSize()
+		if _, ok := exclude[s]; ok || s.IsRotating() || s.Class != class {
+			continue
 		}
+		switch {
+		case sess == nil:
+		case sess.IsSuspect() != s.IsSuspect():
+			if s.IsSuspect() {
+				continue
+			}
+		case sess.priority != s.priority:
+			if s.priority > sess.priority {
+				continue
+			}
+		case sessCost(s) >= sessCost(sess):
+			continue
+		}
+		sess = s
+		size = s.GetSize()
 	}
 	return
 }
@@ -233,18 +509,243 @@ func (sp *SessionPool) sessRun(sess *Session) {
 		// but we can think that as over max_conn line just happened.
 	}()
 
+	sp.reaperOnce.Do(func() {
+		go sp.reaper()
+	})
+	go sess.pinger()
 	sess.Run()
 	// that's mean session is dead
 	log.Warning("session runtime quit, reboot from connect.")
 	return
 }
 
-func (sp *SessionPool) Dial(network, address string) (net.Conn, error) {
+// reaper close idle sessions, rotate old sessions and close them after
+// drained.
+func (sp *SessionPool) reaper() {
+	ticker := time.NewTicker(REAP_INTERVAL * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sp.reap()
+		case <-sp.stop:
+			return
+		}
+	}
+}
+
+func (sp *SessionPool) reap() {
+	if sp.IsClosing() {
+		return
+	}
+	var closing []*Session
+	alive := map[string]int{
+		CLASS_INTERACTIVE: sp.countAlive(CLASS_INTERACTIVE),
+		CLASS_BULK:        sp.countAlive(CLASS_BULK),
+	}
+
+	sp.mu.Lock()
+	for s, _ := range sp.sess {
+		minsess, _ := sp.classSize(s.Class)
+		switch {
+		case s.IsRotating():
+		case sp.MaxAge != 0 && s.GetAge() > sp.MaxAge:
+			s.Rotate()
+			alive[s.Class]--
+		case sp.IdleTimeout != 0 && s.GetIdle() > sp.IdleTimeout && alive[s.Class] > minsess:
+			log.Noticef("%s idle for %s, close it.", s.String(), s.GetIdle())
+			closing = append(closing, s)
+			alive[s.Class]--
+			continue
+		default:
+			continue
+		}
+		if s.GetIdle() > DRAIN_GRACE*time.Second {
+			log.Noticef("%s rotated and drained, close it.", s.String())
+			closing = append(closing, s)
+		}
+	}
+	sp.mu.Unlock()
+
+	for _, s := range closing {
+		s.Close()
+	}
+
+	for class, n := range alive {
+		minsess, _ := sp.classSize(class)
+		if n < minsess {
+			// replace rotated sessions before new streams come.
+			class := class
+			go sp.createSession(func() bool {
+				return sp.countAlive(class) < minsess
+			}, class)
+		}
+	}
+}
+
+func (sp *SessionPool) Dial(network, address string) (conn net.Conn, err error) {
+	return sp.DialContext(context.Background(), network, address)
+}
+
+// DialContext stop retrying and reset the stream when ctx done.
+func (sp *SessionPool) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	class := CLASS_INTERACTIVE
+	if !strings.HasPrefix(network, "udp") {
+		class = sp.classify(address)
+	}
+
+	tried := make(map[*Session]struct{}, 0)
+	for i := 0; ; i++ {
+		var sess *Session
+		sess, err = sp.get(class, tried)
+		if err != nil && class == CLASS_BULK {
+			log.Warningf("no bulk session for %s, use interactive.", address)
+			class = CLASS_INTERACTIVE
+			sess, err = sp.get(class, tried)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err = sp.dialIn(ctx, sess, network, address)
+		if err == nil || ctx.Err() != nil || i >= sp.DialRetry || !sp.retryable(err) {
+			return
+		}
+		var de *DialError
+		if errors.As(err, &de) && de.Errno == ERR_CLOSED && !de.Local {
+			// remote is shutting down, stop using this session.
+			sess.Rotate()
+		}
+		log.Warningf("dial %s in session %s failed, retry in another one.",
+			address, sess.String())
+		tried[sess] = struct{}{}
+	}
+}
+
+// retryable tell if a dial failed may success in another session.
+func (sp *SessionPool) retryable(err error) bool {
+	var de *DialError
+	if !errors.As(err, &de) {
+		// syn can't be sent, session broken.
+		return true
+	}
+	switch {
+	case de.Local, de.Errno == ERR_IDEXIST, de.Errno == ERR_CLOSED:
+		return true
+	case de.Errno == ERR_DENIED, de.Errno == ERR_FORBIDDEN, de.Errno == ERR_AUTH,
+		de.Errno == ERR_QUOTA:
+		return false
+	}
+	return sp.RetryAll
+}
+
+func (sp *SessionPool) dialIn(ctx context.Context, sess *Session, network, address string) (net.Conn, error) {
+	// old server can't accept udp frames, use a stream for the flow.
+	if strings.HasPrefix(network, "udp") && sess.datagram {
+		dc, err := sess.DialDatagram(address)
+		if err != nil {
+			return nil, err
+		}
+		return dc, nil
+	}
+
+	var c *Conn
+	var err error
+	if sp.FastOpen {
+		c, err = sess.DialFastContext(ctx, network, address)
+	} else {
+		c, err = sess.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ListenDatagram return a PacketConn, which can send datagram to any address.
+func (sp *SessionPool) ListenDatagram() (net.PacketConn, error) {
 	sess, err := sp.Get()
 	if err != nil {
-		return nil, nil
+		return nil, err
+	}
+	dc, err := sess.ListenDatagram()
+	if err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// AddRemoteBind keep a bind in one of sessions, bind again when lost.
+// Connections accepted in remote address will be dialed to target by dialer.
+func (sp *SessionPool) AddRemoteBind(network, address, target string, dialer sutils.Dialer) {
+	go func() {
+		for !sp.IsClosing() {
+			sess, err := sp.Get()
+			if err == nil {
+				var cb *ClientBind
+				cb, err = sess.Bind(network, address, target, dialer)
+				if err == nil {
+					<-cb.Done()
+					log.Warningf("remote bind %s lost, bind again.", address)
+					continue
+				}
+			}
+			log.Errorf("%s", err)
+			time.Sleep(BIND_RETRY * time.Second)
+		}
+	}()
+}
+
+func (sp *SessionPool) IsClosing() bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.closing
+}
+
+func (sp *SessionPool) countStreams() (n int) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for s, _ := range sp.sess {
+		n += s.GetStreams()
 	}
-	return sess.Dial(network, address)
+	return
+}
+
+// Shutdown stop new streams and binds, wait streams finished until timeout,
+// then abort the rest and close all sessions.
+// ErrShutdownTimeout returned if any stream aborted.
+func (sp *SessionPool) Shutdown(timeout time.Duration) (err error) {
+	sp.mu.Lock()
+	if !sp.closing {
+		close(sp.stop)
+	}
+	sp.closing = true
+	var sesses []*Session
+	for s, _ := range sp.sess {
+		sesses = append(sesses, s)
+	}
+	sp.mu.Unlock()
+
+	for _, s := range sesses {
+		s.Drain()
+		s.unbindAll()
+	}
+
+	deadline := time.Now().Add(timeout)
+	log.Noticef("waiting for %d streams to finish in %s.", sp.countStreams(), timeout)
+	for sp.countStreams() > 0 && time.Now().Before(deadline) {
+		time.Sleep(SHUTDOWN_POLL * time.Millisecond)
+	}
+
+	for _, s := range sesses {
+		for _, c := range s.GetPorts() {
+			log.Warningf("%s not finished, abort.", c.String())
+			c.Abort()
+			err = ErrShutdownTimeout
+		}
+		s.Close()
+	}
+	return
 }
 
 func (sp *SessionPool) LookupIP(host string) (addrs []net.IP, err error) {
@@ -254,3 +755,12 @@ func (sp *SessionPool) LookupIP(host string) (addrs []net.IP, err error) {
 	}
 	return sess.LookupIP(host)
 }
+
+// Exchange send dns query through one of sessions.
+func (sp *SessionPool) Exchange(req *dns.Msg) (res *dns.Msg, err error) {
+	sess, err := sp.Get()
+	if err != nil {
+		return
+	}
+	return sess.Exchange(req)
+}
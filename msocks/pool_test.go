@@ -0,0 +1,319 @@
+package msocks
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/shell909090/goproxy/sutils"
+)
+
+// pipeDialer connect to ms by net.Pipe, fail if failing set.
+type pipeDialer struct {
+	ms      *MsocksServer
+	failing int32
+}
+
+func (pd *pipeDialer) Dial(network, address string) (net.Conn, error) {
+	return pd.DialContext(context.Background(), network, address)
+}
+
+func (pd *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if atomic.LoadInt32(&pd.failing) != 0 {
+		return nil, errors.New("connect failed")
+	}
+	c1, c2 := net.Pipe()
+	go pd.ms.Handler(c2)
+	return c1, nil
+}
+
+func newPipeDialer(t *testing.T, failing bool) *pipeDialer {
+	ms, err := NewServer(nil, sutils.DefaultTcpDialer)
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+	pd := &pipeDialer{ms: ms}
+	if failing {
+		pd.failing = 1
+	}
+	return pd
+}
+
+func TestOrderFactoriesBreaker(t *testing.T) {
+	sp := CreateSessionPool(0, 0)
+	primary := sp.AddSessionFactory(nil, "primary", "", "")
+	backup := sp.AddSessionFactory(nil, "backup", "", "")
+	backup.Priority = 1
+
+	asfs := sp.orderFactories(math.MaxInt32, CLASS_INTERACTIVE, true)
+	if len(asfs) != 2 || asfs[0] != primary {
+		t.Fatalf("primary should be first")
+	}
+
+	for i := 0; i < BREAKER_THRESHOLD; i++ {
+		primary.Health.RecordFailure()
+	}
+	asfs = sp.orderFactories(math.MaxInt32, CLASS_INTERACTIVE, true)
+	if len(asfs) != 1 || asfs[0] != backup {
+		t.Fatalf("primary with circuit open should be skipped")
+	}
+
+	// better than backup, only primary, which is open.
+	asfs = sp.orderFactories(1, CLASS_INTERACTIVE, false)
+	if len(asfs) != 0 {
+		t.Fatalf("server with circuit open should not be tried without fallback")
+	}
+	asfs = sp.orderFactories(1, CLASS_INTERACTIVE, true)
+	if len(asfs) != 1 || asfs[0] != primary {
+		t.Fatalf("server closed first should be tried with fallback")
+	}
+}
+
+func TestPriorityFailover(t *testing.T) {
+	pd1 := newPipeDialer(t, true)
+	pd2 := newPipeDialer(t, false)
+	sp := CreateSessionPool(1, 16)
+	defer sp.CutAll()
+	sp.AddSessionFactory(pd1, "primary", "", "")
+	backup := sp.AddSessionFactory(pd2, "backup", "", "")
+	backup.Priority = 1
+
+	sess, err := sp.Get()
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	if sess.priority != 1 {
+		t.Fatalf("backup should be used when primary failed")
+	}
+
+	// primary come back, new streams go back to it.
+	atomic.StoreInt32(&pd1.failing, 0)
+	for i := 0; i < 100 && sess.priority != 0; i++ {
+		sess, err = sp.Get()
+		if err != nil {
+			t.Fatalf("Get failed: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sess.priority != 0 {
+		t.Fatalf("primary not used after it come back")
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for s := range sp.sess {
+		if s.priority == 1 && !s.IsRotating() {
+			t.Fatalf("idle backup should be drained")
+		}
+	}
+}
+
+func hasSession(sp *SessionPool, s *Session) bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	_, ok := sp.sess[s]
+	return ok
+}
+
+func waitAlive(sp *SessionPool, n int) bool {
+	for i := 0; i < 100; i++ {
+		if sp.countAlive("") == n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestReapIdle(t *testing.T) {
+	pd := newPipeDialer(t, false)
+	sp := CreateSessionPool(1, 16)
+	defer sp.CutAll()
+	sp.AddSessionFactory(pd, "server", "", "")
+	sp.IdleTimeout = time.Millisecond
+
+	for i := 0; i < 3; i++ {
+		err := sp.createSession(nil, CLASS_INTERACTIVE)
+		if err != nil {
+			t.Fatalf("createSession failed: %s", err)
+		}
+	}
+	// one session carry only a datagram flow, it's not idle.
+	sess, _ := sp.getLessSess(CLASS_INTERACTIVE, nil)
+	dc, err := sess.DialDatagram("127.0.0.1:53")
+	if err != nil {
+		t.Fatalf("DialDatagram failed: %s", err)
+	}
+	defer dc.Close()
+	time.Sleep(5 * time.Millisecond)
+
+	sp.reap()
+	if !waitAlive(sp, 1) {
+		t.Fatalf("idle sessions should be closed down to MinSess")
+	}
+	if !hasSession(sp, sess) {
+		t.Fatalf("session with datagram flow should not be reaped")
+	}
+}
+
+func TestReapMaxAge(t *testing.T) {
+	pd := newPipeDialer(t, false)
+	sp := CreateSessionPool(1, 16)
+	defer sp.CutAll()
+	sp.AddSessionFactory(pd, "server", "", "")
+
+	sess, err := sp.Get()
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	sp.MaxAge = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+
+	sp.reap()
+	if !sess.IsRotating() {
+		t.Fatalf("old session should be rotated")
+	}
+	if !hasSession(sp, sess) {
+		t.Fatalf("rotated session should not be closed in grace time")
+	}
+
+	// replacement created in background.
+	sp.MaxAge = 0
+	if !waitAlive(sp, 1) {
+		t.Fatalf("rotated session not replaced")
+	}
+
+	atomic.StoreInt64(&sess.lastused, time.Now().Add(-DRAIN_GRACE*time.Second).UnixNano()-1)
+	sp.reap()
+	for i := 0; i < 100; i++ {
+		if !hasSession(sp, sess) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("rotated session not closed after drained")
+}
+
+func TestShutdownRefuseAdd(t *testing.T) {
+	pd := newPipeDialer(t, false)
+	sp := CreateSessionPool(1, 16)
+	sp.AddSessionFactory(pd, "server", "", "")
+	if _, err := sp.Get(); err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+
+	sp.Shutdown(time.Second)
+	select {
+	case <-sp.stop:
+	default:
+		t.Fatalf("reaper should be stopped by shutdown")
+	}
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := NewSession(c1)
+	if err := sp.Add(s); err != ErrShutdown {
+		t.Fatalf("Add after shutdown should fail, got %v", err)
+	}
+	if hasSession(sp, s) {
+		t.Fatalf("session added after shutdown")
+	}
+	// shutdown twice should be safe.
+	sp.Shutdown(0)
+}
+
+// newUpstreamPair create sessions, server of them go through upstream.
+func newUpstreamPair(t *testing.T) (client, server *Session, up *MsocksServer, sp *SessionPool) {
+	pd := newPipeDialer(t, false)
+	sp = CreateSessionPool(0, 0)
+	sp.AddSessionFactory(pd, "upstream", "", "")
+
+	c1, c2 := net.Pipe()
+	client = NewMuxSession(c1, false)
+	server = NewMuxSession(c2, true)
+	server.server = &MsocksServer{Resolver: NewResolver()}
+	server.dialer = sp
+	go client.Run()
+	go server.Run()
+	return client, server, pd.ms, sp
+}
+
+func TestDatagramUpstream(t *testing.T) {
+	client, server, _, sp := newUpstreamPair(t)
+	defer client.Close()
+	defer server.Close()
+	defer sp.CutAll()
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	dst := echo.LocalAddr().String()
+	dc, err := client.DialDatagram(dst)
+	if err != nil {
+		t.Fatalf("DialDatagram failed: %s", err)
+	}
+	defer dc.Close()
+	_, err = dc.Write([]byte("ping"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	buf := make([]byte, 16)
+	n, err := dc.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("echo failed: %q %v", buf[:n], err)
+	}
+
+	server.dlock.Lock()
+	ne := server.nat[dc.src]
+	server.dlock.Unlock()
+	ne.lock.Lock()
+	defer ne.lock.Unlock()
+	if ne.ups[dst] == nil {
+		t.Fatalf("datagram should be sent by upstream")
+	}
+}
+
+func TestDnsUpstream(t *testing.T) {
+	client, server, up, sp := newUpstreamPair(t)
+	defer client.Close()
+	defer server.Close()
+	defer sp.CutAll()
+	// only upstream know the name.
+	cacheAddr(up.Resolver, "up.example.com", "192.0.2.9")
+	server.server.Resolver.Blocked = []string{"blocked.example.com"}
+	cacheAddr(up.Resolver, "blocked.example.com", "192.0.2.10")
+
+	req := new(dns.Msg)
+	req.SetQuestion("up.example.com.", dns.TypeA)
+	res, err := client.Exchange(req)
+	if err != nil {
+		t.Fatalf("Exchange failed: %s", err)
+	}
+	if len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "192.0.2.9" {
+		t.Fatalf("dns should be answered by upstream, got %v", res)
+	}
+
+	req.SetQuestion("blocked.example.com.", dns.TypeA)
+	res, err = client.Exchange(req)
+	if err != nil || res.Rcode != dns.RcodeNameError {
+		t.Fatalf("blocked name should not go upstream, got %v %v", res, err)
+	}
+}
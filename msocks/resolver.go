@@ -0,0 +1,352 @@
+package msocks
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/shell909090/goproxy/sutils"
+)
+
+// Resolver answer dns queries from client in server. Answers are cached
+// by ttl. Queries go to dns servers of sutils.DefaultLookuper if it is a
+// *sutils.DnsLookup, or system resolver (A and AAAA only) if it's not or
+// servers failed.
+// Prefer can be "ipv4" or "ipv6". If set, query of the other type will
+// get empty answer when the name has address of preferred type.
+// Domains match Blocked (see sutils.MatchHostRule) get NXDOMAIN.
+type Resolver struct {
+	Prefer  string
+	Blocked []string
+
+	cache *DnsCache
+}
+
+// DnsCache keep answers by question, until minimum ttl in answer passed.
+// At most DNS_CACHE_MAX answers kept.
+type DnsCache struct {
+	lock    sync.Mutex
+	entries map[dnsKey]*dnsEntry
+}
+
+type dnsKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type dnsEntry struct {
+	msg    *dns.Msg
+	stored time.Time
+	expire time.Time
+}
+
+func NewResolver() *Resolver {
+	return &Resolver{cache: NewDnsCache()}
+}
+
+func NewDnsCache() *DnsCache {
+	return &DnsCache{entries: make(map[dnsKey]*dnsEntry)}
+}
+
+var defaultResolver = NewResolver()
+
+func keyOf(q dns.Question) dnsKey {
+	return dnsKey{strings.ToLower(q.Name), q.Qtype, q.Qclass}
+}
+
+// Get return a copy of answer to q, nil if not cached.
+func (c *DnsCache) Get(q dns.Question) *dns.Msg {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[keyOf(q)]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.After(e.expire) {
+		delete(c.entries, keyOf(q))
+		return nil
+	}
+
+	// ttl in answer should be decreased by time passed. Entry expire by
+	// minimum ttl in answer, rr in other sections may have lower ttl.
+	m := e.msg.Copy()
+	passed := uint32(now.Sub(e.stored) / time.Second)
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			h := rr.Header()
+			switch {
+			case h.Rrtype == dns.TypeOPT:
+			case h.Ttl > passed:
+				h.Ttl -= passed
+			default:
+				h.Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+// ttl of answer is the minimum ttl in it. Negative answer use minttl of
+// soa in authority section.
+func ttlOf(m *dns.Msg) (ttl uint32) {
+	ttl = DNS_NEG_TTL
+	found := false
+	for _, rr := range m.Answer {
+		if !found || rr.Header().Ttl < ttl {
+			ttl, found = rr.Header().Ttl, true
+		}
+	}
+	if found {
+		return
+	}
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+	}
+	return
+}
+
+// Put keep answer m to q. Only success and NXDOMAIN are cached.
+// truncated answer is not cached, or it will be served until expired.
+func (c *DnsCache) Put(q dns.Question, m *dns.Msg) {
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return
+	}
+	if m.Truncated {
+		return
+	}
+	ttl := ttlOf(m)
+	if ttl == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if len(c.entries) >= DNS_CACHE_MAX {
+		for k, e := range c.entries {
+			if now.After(e.expire) {
+				delete(c.entries, k)
+			}
+		}
+		// still full, drop any one.
+		for k := range c.entries {
+			if len(c.entries) < DNS_CACHE_MAX {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[keyOf(q)] = &dnsEntry{
+		msg:    m.Copy(),
+		stored: now,
+		expire: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// lookup query upstream without policy, with cache. req is forwarded as
+// it is, with a new id, so edns0 options of client are kept.
+func (r *Resolver) lookup(req *dns.Msg) (m *dns.Msg, err error) {
+	q := req.Question[0]
+	m = r.cache.Get(q)
+	if m != nil {
+		return
+	}
+
+	req = req.Copy()
+	req.Id = dns.Id()
+
+	d, ok := sutils.DefaultLookuper.(*sutils.DnsLookup)
+	if ok {
+		m, err = d.Exchange(req)
+		if err == nil && m == nil {
+			err = ErrNoDnsServer
+		}
+	}
+	addr := q.Qclass == dns.ClassINET && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA)
+	if !ok || (err != nil && addr) {
+		if ok {
+			log.Infof("dns servers failed for %s: %s, try system resolver.", q.Name, err)
+		}
+		m, err = systemExchange(req)
+	}
+	if err != nil {
+		return
+	}
+	r.cache.Put(q, m)
+	return
+}
+
+// systemExchange answer A and AAAA query by system resolver.
+func systemExchange(req *dns.Msg) (m *dns.Msg, err error) {
+	m = new(dns.Msg)
+	m.SetReply(req)
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+		m.Rcode = dns.RcodeNotImplemented
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DNS_TIMEOUT*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, strings.TrimSuffix(q.Name, "."))
+	if err != nil {
+		if de, ok := err.(*net.DNSError); ok && de.IsNotFound {
+			m.Rcode = dns.RcodeNameError
+			return m, nil
+		}
+		return nil, err
+	}
+
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: DNS_SYSTEM_TTL}
+	for _, a := range addrs {
+		ip4 := a.IP.To4()
+		switch {
+		case q.Qtype == dns.TypeA && ip4 != nil:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+		case q.Qtype == dns.TypeAAAA && ip4 == nil:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: a.IP})
+		}
+	}
+	return
+}
+
+func (c *DnsCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+func (r *Resolver) blocked(name string) bool {
+	host := strings.TrimSuffix(strings.ToLower(name), ".")
+	for _, rule := range r.Blocked {
+		if sutils.MatchHostRule(rule, host, "") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAddr tell if name in req has address of type t.
+func (r *Resolver) hasAddr(req *dns.Msg, t uint16) bool {
+	req = req.Copy()
+	req.Question[0].Qtype = t
+	m, err := r.lookup(req)
+	if err != nil || m.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Exchange answer req by policy and cache. Failed query will get SERVFAIL,
+// never error.
+func (r *Resolver) Exchange(req *dns.Msg) (res *dns.Msg) {
+	res = new(dns.Msg)
+	if len(req.Question) != 1 {
+		res.SetRcode(req, dns.RcodeFormatError)
+		return
+	}
+	q := req.Question[0]
+
+	if r.blocked(q.Name) {
+		log.Noticef("dns query for %s blocked.", q.Name)
+		res.SetRcode(req, dns.RcodeNameError)
+		return
+	}
+
+	var other uint16
+	switch {
+	case r.Prefer == "ipv4" && q.Qtype == dns.TypeAAAA:
+		other = dns.TypeA
+	case r.Prefer == "ipv6" && q.Qtype == dns.TypeA:
+		other = dns.TypeAAAA
+	}
+	if other != 0 && r.hasAddr(req, other) {
+		log.Debugf("dns query for %s type %d suppressed by prefer %s.", q.Name, q.Qtype, r.Prefer)
+		res.SetReply(req)
+		return
+	}
+
+	m, err := r.lookup(req)
+	if err != nil {
+		log.Errorf("dns query for %s failed: %s", q.Name, err)
+		res.SetRcode(req, dns.RcodeServerFailure)
+		return
+	}
+	m.Id = req.Id
+	return m
+}
+
+func (r *Resolver) query(host string, t uint16) (addrs []net.IP, err error) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(host), t)
+	req.RecursionDesired = true
+
+	res := r.Exchange(req)
+	switch res.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: dns.RcodeToString[res.Rcode], Name: host}
+	}
+	for _, a := range res.Answer {
+		switch ta := a.(type) {
+		case *dns.A:
+			addrs = append(addrs, ta.A)
+		case *dns.AAAA:
+			addrs = append(addrs, ta.AAAA)
+		}
+	}
+	return
+}
+
+type lookupResult struct {
+	addrs []net.IP
+	err   error
+}
+
+// LookupIP resolve host by policy and cache, like queries from clients,
+// ipv4 addresses come first. Fail if both A and AAAA failed or no address.
+// A and AAAA are queried at the same time.
+func (r *Resolver) LookupIP(ctx context.Context, host string) (addrs []net.IP, err error) {
+	ch4 := make(chan *lookupResult, 1)
+	ch6 := make(chan *lookupResult, 1)
+	query := func(t uint16, ch chan *lookupResult) {
+		addrs, err := r.query(host, t)
+		ch <- &lookupResult{addrs, err}
+	}
+	go query(dns.TypeA, ch4)
+	go query(dns.TypeAAAA, ch6)
+
+	var r4, r6 *lookupResult
+	for r4 == nil || r6 == nil {
+		select {
+		case r4 = <-ch4:
+		case r6 = <-ch6:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	addrs = append(r4.addrs, r6.addrs...)
+	switch {
+	case r4.err != nil && r6.err != nil:
+		return nil, r4.err
+	case len(addrs) == 0:
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
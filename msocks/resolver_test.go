@@ -0,0 +1,217 @@
+package msocks
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/shell909090/goproxy/sutils"
+)
+
+// cacheAddr seed cache of r, so name resolved to ips without network.
+func cacheAddr(r *Resolver, name string, ips ...string) {
+	for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(name), t)
+		m.Response = true
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			hdr := dns.RR_Header{Name: dns.Fqdn(name), Rrtype: t, Class: dns.ClassINET, Ttl: 60}
+			switch {
+			case t == dns.TypeA && ip.To4() != nil:
+				m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip})
+			case t == dns.TypeAAAA && ip.To4() == nil:
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		r.cache.Put(m.Question[0], m)
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	r := NewResolver()
+	q := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	m := new(dns.Msg)
+	m.SetQuestion(q.Name, q.Qtype)
+	m.Response = true
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	m.Ns = append(m.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 1},
+		Ns:     "ns.example.com.",
+		Mbox:   "admin.example.com.",
+		Minttl: 30,
+	})
+	r.cache.Put(q, m)
+
+	e := r.cache.entries[keyOf(q)]
+	if e == nil || e.expire.Sub(e.stored) != 60*time.Second {
+		t.Fatalf("entry should expire by ttl of answer: %v", e)
+	}
+	e.stored = e.stored.Add(-2 * time.Second)
+
+	// key is case insensitive.
+	q.Name = "WWW.example.com."
+	c := r.cache.Get(q)
+	if c == nil {
+		t.Fatalf("answer not cached")
+	}
+	if ttl := c.Answer[0].Header().Ttl; ttl != 58 {
+		t.Fatalf("ttl should be decreased, got %d", ttl)
+	}
+	if ttl := c.Ns[0].Header().Ttl; ttl != 0 {
+		t.Fatalf("ttl lower than time passed should be 0, got %d", ttl)
+	}
+
+	e.expire = time.Now().Add(-time.Second)
+	if r.cache.Get(q) != nil || r.cache.Len() != 0 {
+		t.Fatalf("expired entry should be removed")
+	}
+
+	m.Rcode = dns.RcodeServerFailure
+	r.cache.Put(q, m)
+	if r.cache.Get(q) != nil {
+		t.Fatalf("SERVFAIL should not be cached")
+	}
+
+	m.Rcode = dns.RcodeSuccess
+	m.Truncated = true
+	r.cache.Put(q, m)
+	if r.cache.Get(q) != nil {
+		t.Fatalf("truncated answer should not be cached")
+	}
+}
+
+func TestResolverPolicy(t *testing.T) {
+	r := NewResolver()
+	r.Blocked = []string{"*.blocked.com"}
+	cacheAddr(r, "both.example.com", "192.0.2.1", "2001:db8::1")
+	cacheAddr(r, "v6.example.com", "2001:db8::2")
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.Blocked.com.", dns.TypeA)
+	if res := r.Exchange(req); res.Rcode != dns.RcodeNameError || res.Id != req.Id {
+		t.Fatalf("blocked domain should get NXDOMAIN, got %v", res)
+	}
+
+	req.SetQuestion("both.example.com.", dns.TypeAAAA)
+	if res := r.Exchange(req); res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 {
+		t.Fatalf("AAAA should be answered without prefer, got %v", res)
+	}
+
+	r.Prefer = "ipv4"
+	if res := r.Exchange(req); res.Rcode != dns.RcodeSuccess || len(res.Answer) != 0 || res.Id != req.Id {
+		t.Fatalf("AAAA should be suppressed when A exists, got %v", res)
+	}
+	req.SetQuestion("v6.example.com.", dns.TypeAAAA)
+	if res := r.Exchange(req); len(res.Answer) != 1 {
+		t.Fatalf("AAAA should be answered when no A, got %v", res)
+	}
+}
+
+func TestResolverServfail(t *testing.T) {
+	lookuper := sutils.DefaultLookuper
+	defer func() { sutils.DefaultLookuper = lookuper }()
+	// no dns server, and system resolver can't answer MX.
+	sutils.DefaultLookuper = sutils.NewDnsLookup(nil, "")
+
+	r := NewResolver()
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeMX)
+	res := r.Exchange(req)
+	if res.Rcode != dns.RcodeServerFailure || res.Id != req.Id || !res.Response {
+		t.Fatalf("failed query should get SERVFAIL, got %v", res)
+	}
+	if r.cache.Len() != 0 {
+		t.Fatalf("failure should not be cached")
+	}
+
+	req.Question = append(req.Question, req.Question[0])
+	if res = r.Exchange(req); res.Rcode != dns.RcodeFormatError {
+		t.Fatalf("multiple questions should get FORMERR, got %v", res)
+	}
+}
+
+// startDnsServer serve answers by handler in tcp, and use it as dns
+// server of sutils.DefaultLookuper until returned func called.
+func startDnsServer(t *testing.T, handler dns.HandlerFunc) func() {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	srv := &dns.Server{Listener: l, Handler: handler}
+	go srv.ActivateAndServe()
+
+	lookuper := sutils.DefaultLookuper
+	sutils.DefaultLookuper = sutils.NewDnsLookup([]string{l.Addr().String()}, "tcp")
+	return func() {
+		sutils.DefaultLookuper = lookuper
+		srv.Shutdown()
+	}
+}
+
+func TestResolverForward(t *testing.T) {
+	sizes := make(chan uint16, 4)
+	stop := startDnsServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		var size uint16
+		if opt := req.IsEdns0(); opt != nil {
+			size = opt.UDPSize()
+		}
+		sizes <- size
+		q := req.Question[0]
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	r := NewResolver()
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	res := r.Exchange(req)
+	if res.Rcode != dns.RcodeSuccess || res.Id != req.Id || len(res.Answer) != 1 {
+		t.Fatalf("query failed: %v", res)
+	}
+	if size := <-sizes; size != 4096 {
+		t.Fatalf("edns0 of client not forwarded, udp size %d", size)
+	}
+
+}
+
+func TestResolverLookupIP(t *testing.T) {
+	stop := startDnsServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		m := new(dns.Msg)
+		m.SetReply(req)
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+		time.Sleep(200 * time.Millisecond)
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.1")})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+		}
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	r := NewResolver()
+	start := time.Now()
+	addrs, err := r.LookupIP(context.Background(), "www.example.com")
+	if err != nil || len(addrs) != 2 || addrs[0].To4() == nil {
+		t.Fatalf("LookupIP wrong: %v %v", addrs, err)
+	}
+	if d := time.Since(start); d >= 400*time.Millisecond {
+		t.Fatalf("A and AAAA not queried at the same time: %s", d)
+	}
+}
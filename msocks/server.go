@@ -4,6 +4,8 @@ import (
 	"errors"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shell909090/goproxy/sutils"
@@ -11,8 +13,28 @@ import (
 
 type MsocksServer struct {
 	*SessionPool
-	userpass map[string]string
-	dialer   sutils.Dialer
+	userpass  map[string]string
+	dialer    sutils.Dialer
+	bindports map[string][]PortRange
+	acls      map[string]*ACL
+
+	ulock  sync.Mutex
+	limits map[string]*Limit
+	usages map[string]*Usage
+
+	// MaxSockets limit udp sockets for nat of all sessions, 0 means no limit.
+	MaxSockets int32
+	sockets    int32
+
+	Guard    *Guard
+	Resolver *Resolver
+	// Accounting and Audit are nil if not enabled.
+	Accounting *Accounting
+	Audit      *AuditLog
+
+	lock     sync.Mutex
+	listener net.Listener
+	closing  bool
 }
 
 func NewServer(auth map[string]string, dialer sutils.Dialer) (ms *MsocksServer, err error) {
@@ -24,6 +46,9 @@ func NewServer(auth map[string]string, dialer sutils.Dialer) (ms *MsocksServer,
 	ms = &MsocksServer{
 		SessionPool: CreateSessionPool(0, 0),
 		dialer:      dialer,
+		Guard:       NewGuard(),
+		Resolver:    NewResolver(),
+		MaxSockets:  UDP_SOCKETS_MAX,
 	}
 
 	if auth != nil {
@@ -32,7 +57,32 @@ func NewServer(auth map[string]string, dialer sutils.Dialer) (ms *MsocksServer,
 	return
 }
 
-func (ms *MsocksServer) OnAuth(stream io.ReadWriteCloser) (err error) {
+// acquireSocket count one udp socket, return false if too many.
+func (ms *MsocksServer) acquireSocket() bool {
+	if ms == nil {
+		return true
+	}
+	n := atomic.AddInt32(&ms.sockets, 1)
+	if ms.MaxSockets != 0 && n > ms.MaxSockets {
+		atomic.AddInt32(&ms.sockets, -1)
+		log.Warningf("udp sockets exceed %d, refuse.", ms.MaxSockets)
+		return false
+	}
+	return true
+}
+
+func (ms *MsocksServer) releaseSocket() {
+	if ms == nil {
+		return
+	}
+	atomic.AddInt32(&ms.sockets, -1)
+}
+
+func (ms *MsocksServer) GetSockets() int32 {
+	return atomic.LoadInt32(&ms.sockets)
+}
+
+func (ms *MsocksServer) OnAuth(stream io.ReadWriteCloser) (auth *FrameAuth, err error) {
 	f, err := ReadFrame(stream)
 	if err != nil {
 		return
@@ -40,10 +90,11 @@ func (ms *MsocksServer) OnAuth(stream io.ReadWriteCloser) (err error) {
 
 	ft, ok := f.(*FrameAuth)
 	if !ok {
-		return ErrUnexpectedPkg
+		return nil, ErrUnexpectedPkg
 	}
 
-	log.Noticef("auth with username: %s, password: %s.", ft.Username, ft.Password)
+	log.Noticef("auth with username: %s, password: %s, version: %s, hostname: %s.",
+		ft.Username, ft.Password, ft.Version, ft.Hostname)
 	if ms.userpass != nil {
 		password1, ok := ms.userpass[ft.Username]
 		if !ok || (ft.Password != password1) {
@@ -51,67 +102,157 @@ func (ms *MsocksServer) OnAuth(stream io.ReadWriteCloser) (err error) {
 			buf, err := fb.Packed()
 			_, err = stream.Write(buf.Bytes())
 			if err != nil {
-				return err
+				return nil, err
 			}
-			return ErrAuthFailed
+			return nil, ErrAuthFailed
 		}
 	}
 
-	fb := NewFrameResult(ft.Streamid, ERR_NONE)
-	buf, err := fb.Packed()
-	if err != nil {
-		return
+	// session slot will be released by Handler when session quit.
+	usage, ok := ms.acquireUsage(ft.Username)
+	if !ok {
+		log.Warningf("user %s has too many sessions, refuse.", ft.Username)
+		fb := NewFrameResult(ft.Streamid, ERR_LIMIT)
+		if ft.Streamid&CAP_RESULTMSG != 0 {
+			fb = NewFrameResultMsg(ft.Streamid, ERR_LIMIT, "too many sessions")
+		}
+		buf, err := fb.Packed()
+		_, err = stream.Write(buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrTooManySessions
 	}
 
-	_, err = stream.Write(buf.Bytes())
+	fb := NewFrameResult(CAP_DATAGRAM, ERR_NONE)
+	buf, err := fb.Packed()
+	if err == nil {
+		_, err = stream.Write(buf.Bytes())
+	}
 	if err != nil {
+		if usage != nil {
+			usage.release()
+		}
 		return
 	}
 
 	log.Info("auth passed.")
-	return
+	return ft, nil
 }
 
 func (ms *MsocksServer) Handler(conn net.Conn) {
 	log.Noticef("connection come from: %s => %s.", conn.RemoteAddr(), conn.LocalAddr())
 
+	if !ms.Guard.Enter(conn.RemoteAddr()) {
+		log.Infof("%s banned or too many auth waiting, close.", conn.RemoteAddr())
+		return
+	}
+
 	ti := time.AfterFunc(AUTH_TIMEOUT*time.Second, func() {
 		log.Notice(ErrAuthFailed.Error(), conn.RemoteAddr())
 		conn.Close()
 	})
 
-	err := ms.OnAuth(conn)
+	auth, err := ms.OnAuth(conn)
+	ti.Stop()
 	if err != nil {
-		log.Error("%s", err.Error())
+		log.Errorf("%s", err)
+		if err != ErrTooManySessions {
+			ms.Guard.Fail(conn.RemoteAddr(), err)
+		}
 		return
 	}
-	ti.Stop()
+	ms.Guard.Success(conn.RemoteAddr())
+
+	// session slot acquired in OnAuth.
+	usage := ms.getUsage(auth.Username)
+	if usage != nil {
+		defer usage.release()
+	}
 
 	sess := NewSession(conn)
 	sess.next_id = 1
 	sess.dialer = ms.dialer
+	sess.server = ms
+	sess.Username = auth.Username
+	sess.Version = auth.Version
+	sess.Hostname = auth.Hostname
+	sess.resultmsg = auth.Streamid&CAP_RESULTMSG != 0
+	sess.Server = conn.LocalAddr().String()
+	sess.usage = usage
+	if usage != nil {
+		usage.attach(sess)
+		defer usage.detach(sess)
+	}
 
-	ms.Add(sess)
+	if ms.Add(sess) != nil {
+		// shutting down.
+		sess.Close()
+		return
+	}
 	defer ms.Remove(sess)
 	sess.Run()
 
-	log.Noticef("server session %d quit: %s => %s.",
-		sess.LocalPort(), conn.RemoteAddr(), conn.LocalAddr())
+	log.Noticef("server session %s quit: %s => %s, version: %s, hostname: %s, lasted %s.",
+		sess.String(), conn.RemoteAddr(), conn.LocalAddr(), sess.Version, sess.Hostname,
+		sess.GetAge())
 }
 
+// Serve accept sessions until listener closed. Return nil if closed by
+// Shutdown. Temporary errors will be retried with a delay.
 func (ms *MsocksServer) Serve(listener net.Listener) (err error) {
-	var conn net.Conn
+	ms.lock.Lock()
+	ms.listener = listener
+	ms.lock.Unlock()
 
+	var conn net.Conn
+	var delay time.Duration
 	for {
 		conn, err = listener.Accept()
 		if err != nil {
-			log.Error("%s", err)
-			continue
+			ms.lock.Lock()
+			closing := ms.closing
+			ms.lock.Unlock()
+			if closing {
+				return nil
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Errorf("accept error: %s, retry in %s.", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			log.Errorf("%s", err)
+			return err
 		}
-		go func() {
+		delay = 0
+
+		go func(conn net.Conn) {
 			defer conn.Close()
 			ms.Handler(conn)
-		}()
+		}(conn)
+	}
+}
+
+// Shutdown stop accepting new sessions, and drain the sessions exist.
+func (ms *MsocksServer) Shutdown(timeout time.Duration) (err error) {
+	ms.lock.Lock()
+	ms.closing = true
+	if ms.listener != nil {
+		ms.listener.Close()
+	}
+	ms.lock.Unlock()
+	err = ms.SessionPool.Shutdown(timeout)
+	if ms.Accounting != nil {
+		ms.Accounting.Close()
+	}
+	if ms.Audit != nil {
+		ms.Audit.Close()
 	}
 	return
 }
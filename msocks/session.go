@@ -1,12 +1,15 @@
 package msocks
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -22,7 +25,52 @@ type Session struct {
 	next_id uint16
 	ports   map[uint16]FrameSender
 
+	// called for each syn from remote, in session loop.
+	SynHandler func(*Conn)
+	acceptch   chan *Conn
+
+	dlock      sync.Mutex
+	dclosed    bool
+	next_dgram uint32
+	dgrams     map[string]*DatagramConn
+	nat        map[string]*natEntry
+	binds      map[string]*ClientBind
+
+	server   *MsocksServer
+	Username string
+	// Version and Hostname reported by client, in server only.
+	Version  string
+	Hostname string
+	// Server is address of server in client, listen address in server.
+	Server string
+	// resultmsg means remote can parse message in result frame.
+	resultmsg bool
+	// datagram means remote accept udp frames.
+	datagram bool
+	// traffic of user in server, nil if no limit.
+	usage *Usage
+
+	// set when syn got no answer in time, see WaitResult.
+	suspect int32
+
+	health   *ServerHealth
+	priority int
+	pingsent int64
+	rtt      int64
+
+	created  time.Time
+	lastused int64
+	rotating int32
+	draining int32
+
+	// Class is CLASS_INTERACTIVE or CLASS_BULK in client.
+	// onBulk called when one stream received more than bulkThreshold.
+	Class         string
+	bulkThreshold int64
+	onBulk        func(*Conn)
+
 	dialer   sutils.Dialer
+	budget   *MemBudget
 	Readcnt  *sutils.SpeedCounter
 	Writecnt *sutils.SpeedCounter
 }
@@ -32,19 +80,131 @@ func NewSession(conn net.Conn) (s *Session) {
 		conn:     conn,
 		closed:   false,
 		ports:    make(map[uint16]FrameSender, 0),
+		acceptch: make(chan *Conn, ACCEPT_BACKLOG),
+		dgrams:   make(map[string]*DatagramConn, 0),
+		nat:      make(map[string]*natEntry, 0),
+		binds:    make(map[string]*ClientBind, 0),
+		budget:   NewMemBudget(0, nil),
+		created:  time.Now(),
+		lastused: time.Now().UnixNano(),
 		Readcnt:  sutils.NewSpeedCounter(),
 		Writecnt: sutils.NewSpeedCounter(),
 	}
+	s.SynHandler = s.DialHandler
 	log.Noticef("session %s created.", s.String())
 	return
 }
 
+// NewMuxSession create a session work as a general stream multiplexer.
+// Both side can Open streams, and inbound streams come from Accept.
+// One side should be server, for stream id not conflict.
+func NewMuxSession(conn net.Conn, server bool) (s *Session) {
+	s = NewSession(conn)
+	if server {
+		s.next_id = 1
+	}
+	s.SynHandler = s.AcceptHandler
+	s.resultmsg = true
+	s.datagram = true
+	return
+}
+
 func (s *Session) String() string {
+	if s.Username != "" {
+		return fmt.Sprintf("%d(%s)", s.LocalPort(), s.Username)
+	}
 	return fmt.Sprintf("%d", s.LocalPort())
 }
 
-func (s *Session) GetSize() int {
-	return len(s.ports)
+// resultFrame build a result frame with msg, if remote can parse it.
+func (s *Session) resultFrame(streamid uint16, errno uint32, msg string) *FrameResult {
+	if !s.resultmsg {
+		msg = ""
+	}
+	return NewFrameResultMsg(streamid, errno, msg)
+}
+
+// GetSize return number of streams and datagram flows in session.
+func (s *Session) GetSize() (n int) {
+	s.plock.Lock()
+	n = len(s.ports)
+	s.plock.Unlock()
+
+	s.dlock.Lock()
+	n += len(s.dgrams) + len(s.nat)
+	s.dlock.Unlock()
+	return
+}
+
+// MarkSuspect means session may be broken, pool will not put new stream
+// into it unless no other choice.
+func (s *Session) MarkSuspect() {
+	if atomic.CompareAndSwapInt32(&s.suspect, 0, 1) {
+		log.Warningf("%s marked as suspect.", s.String())
+	}
+	if s.health != nil {
+		s.health.RecordError()
+	}
+}
+
+func (s *Session) ClearSuspect() {
+	if atomic.CompareAndSwapInt32(&s.suspect, 1, 0) {
+		log.Noticef("%s recovered from suspect.", s.String())
+	}
+}
+
+func (s *Session) IsSuspect() bool {
+	return atomic.LoadInt32(&s.suspect) != 0
+}
+
+// Rotate stop session from getting new streams, it will be closed by pool
+// after drained.
+func (s *Session) Rotate() {
+	if atomic.CompareAndSwapInt32(&s.rotating, 0, 1) {
+		// idle counts from now, see DRAIN_GRACE.
+		atomic.StoreInt64(&s.lastused, time.Now().UnixNano())
+		log.Noticef("%s start rotating.", s.String())
+	}
+}
+
+// Drain is for shutdown, session rotate and refuse syn from remote.
+func (s *Session) Drain() {
+	s.Rotate()
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+func (s *Session) IsDraining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
+// GetStreams return number of streams, binds not included.
+func (s *Session) GetStreams() int {
+	return len(s.GetPorts())
+}
+
+func (s *Session) IsRotating() bool {
+	return atomic.LoadInt32(&s.rotating) != 0
+}
+
+func (s *Session) GetCreated() time.Time {
+	return s.created
+}
+
+func (s *Session) GetAge() time.Duration {
+	return time.Since(s.created)
+}
+
+// GetIdle return how long session has no stream or datagram flow, 0 if
+// any in it.
+func (s *Session) GetIdle() time.Duration {
+	if s.GetSize() != 0 {
+		return 0
+	}
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&s.lastused))
+}
+
+func (s *Session) GetBuffered() int64 {
+	return s.budget.GetUsed()
 }
 
 func (s *Session) GetPorts() (ports []*Conn) {
@@ -75,9 +235,10 @@ func (s *Session) PutIntoNextId(fs FrameSender) (id uint16, err error) {
 	s.plock.Lock()
 	defer s.plock.Unlock()
 
+	// step by 2, odd ids for server and even ids for client.
 	startid := s.next_id
 	for _, ok := s.ports[s.next_id]; ok; _, ok = s.ports[s.next_id] {
-		s.next_id += 1
+		s.next_id += 2
 		if s.next_id == startid {
 			err = errors.New("run out of stream id")
 			log.Error("%s", err)
@@ -89,6 +250,7 @@ func (s *Session) PutIntoNextId(fs FrameSender) (id uint16, err error) {
 	log.Debugf("%s put into next id %d: %p.", s.String(), id, fs)
 
 	s.ports[id] = fs
+	atomic.StoreInt64(&s.lastused, time.Now().UnixNano())
 	return
 }
 
@@ -103,6 +265,7 @@ func (s *Session) PutIntoId(id uint16, fs FrameSender) (err error) {
 	}
 
 	s.ports[id] = fs
+	atomic.StoreInt64(&s.lastused, time.Now().UnixNano())
 	return
 }
 
@@ -115,16 +278,17 @@ func (s *Session) RemovePort(streamid uint16) (err error) {
 		return fmt.Errorf("streamid(%d) not exist.", streamid)
 	}
 	delete(s.ports, streamid)
+	atomic.StoreInt64(&s.lastused, time.Now().UnixNano())
 	log.Infof("%s remove port %d.", s.String(), streamid)
 	return
 }
 
 func (s *Session) Close() (err error) {
-	log.Warningf("close all connects (%d) for session: %s.",
-		len(s.ports), s.String())
 	defer s.conn.Close()
 	s.plock.Lock()
 	defer s.plock.Unlock()
+	log.Warningf("close all connects (%d) for session: %s.",
+		len(s.ports), s.String())
 
 	s.Readcnt.Close()
 	s.Writecnt.Close()
@@ -132,10 +296,20 @@ func (s *Session) Close() (err error) {
 	for _, v := range s.ports {
 		v.CloseFrame()
 	}
+	if !s.closed {
+		close(s.acceptch)
+	}
 	s.closed = true
+	s.closeDatagrams()
 	return
 }
 
+func (s *Session) IsClosed() bool {
+	s.plock.Lock()
+	defer s.plock.Unlock()
+	return s.closed
+}
+
 func (s *Session) LocalAddr() net.Addr {
 	return s.conn.LocalAddr()
 }
@@ -215,7 +389,24 @@ func (s *Session) Run() {
 				log.Errorf("dns failed: %s", err.Error())
 				return
 			}
+		case *FrameUdp:
+			err = s.on_udp(ft)
+			if err != nil {
+				log.Errorf("udp failed: %s", err.Error())
+				return
+			}
+		case *FrameBind:
+			err = s.on_bind(ft)
+			if err != nil {
+				log.Errorf("bind failed: %s", err.Error())
+				return
+			}
 		case *FramePing:
+			err = s.on_ping(ft)
+			if err != nil {
+				log.Errorf("ping failed: %s", err.Error())
+				return
+			}
 		case *FrameSpam:
 		}
 	}
@@ -224,9 +415,19 @@ func (s *Session) Run() {
 // no drop, any error will reset main connection
 func (s *Session) sendFrameInChan(f Frame) (err error) {
 	streamid := f.GetStreamid()
+	s.plock.Lock()
 	c, ok := s.ports[streamid]
+	s.plock.Unlock()
 	if !ok || c == nil {
-		return ErrStreamNotExist
+		switch f.(type) {
+		case *FrameResult, *FrameData:
+			// stream already gone, let remote know.
+			log.Infof("%s(%d) not exist, send rst back.", s.String(), streamid)
+			return s.SendFrame(NewFrameRst(streamid))
+		}
+		// wnd, fin, rst or dns for a closed stream, just drop it.
+		log.Debugf("%s(%d) not exist, drop %s", s.String(), streamid, f.Debug())
+		return nil
 	}
 
 	err = c.SendFrame(f)
@@ -239,6 +440,11 @@ func (s *Session) sendFrameInChan(f Frame) (err error) {
 // ---- syn part ----
 
 func (s *Session) Dial(network, address string) (c *Conn, err error) {
+	return s.DialContext(context.Background(), network, address)
+}
+
+// DialContext stop waiting and reset stream if ctx done before connected.
+func (s *Session) DialContext(ctx context.Context, network, address string) (c *Conn, err error) {
 	c = NewConn(ST_SYN_SENT, 0, s, network, address)
 	streamid, err := s.PutIntoNextId(c)
 	if err != nil {
@@ -247,20 +453,73 @@ func (s *Session) Dial(network, address string) (c *Conn, err error) {
 	c.streamid = streamid
 
 	log.Infof("try dial %s => %s.", s.conn.RemoteAddr().String(), address)
-	err = c.WaitForConn()
+	err = c.WaitForConn(ctx)
 	if err != nil {
-		return
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// DialFast return conn right after syn sent, not wait for result.
+// Data written before connected will be buffered by remote until target
+// connected. If remote connect failed, error will be returned by Read/Write.
+func (s *Session) DialFast(network, address string) (c *Conn, err error) {
+	return s.DialFastContext(context.Background(), network, address)
+}
+
+// DialFastContext reset stream if ctx done before result come back.
+func (s *Session) DialFastContext(ctx context.Context, network, address string) (c *Conn, err error) {
+	c = NewConn(ST_SYN_SENT, 0, s, network, address)
+	c.fastopen = true
+	streamid, err := s.PutIntoNextId(c)
+	if err != nil {
+		return nil, err
+	}
+	c.streamid = streamid
+
+	log.Infof("try fast dial %s => %s.", s.conn.RemoteAddr().String(), address)
+	err = c.SendSyn()
+	if err != nil {
+		return nil, err
 	}
 
+	c.dialed = make(chan struct{})
+	go func() {
+		c.dialret = c.WaitResult(ctx)
+		close(c.dialed)
+	}()
 	return c, nil
 }
 
 func (s *Session) on_syn(ft *FrameSyn) (err error) {
+	if s.IsDraining() {
+		log.Infof("%s draining, refuse %s.", s.String(), ft.Address)
+		s.auditRefused(ft.Network, ft.Address, "shutting down")
+		return s.SendFrame(s.resultFrame(ft.Streamid, ERR_CLOSED, "shutting down"))
+	}
+	if s.usage != nil && s.usage.Exceeded() {
+		log.Warningf("%s over quota, refuse %s.", s.String(), ft.Address)
+		s.auditRefused(ft.Network, ft.Address, "quota exceeded")
+		return s.SendFrame(s.resultFrame(ft.Streamid, ERR_QUOTA, "quota exceeded"))
+	}
+	if s.usage != nil {
+		if reason := s.usage.checkSyn(); reason != "" {
+			log.Warningf("%s %s, refuse %s.", s.String(), reason, ft.Address)
+			s.auditRefused(ft.Network, ft.Address, reason)
+			return s.SendFrame(s.resultFrame(ft.Streamid, ERR_LIMIT, reason))
+		}
+	}
+
 	// lock streamid temporary, with status sync recved
 	c := NewConn(ST_SYN_RECV, ft.Streamid, s, ft.Network, ft.Address)
+	// rst from remote or session closed will cancel it, see Final.
+	c.ctx, c.cancel = context.WithTimeout(context.Background(), DIAL_TIMEOUT*time.Second)
 	err = s.PutIntoId(ft.Streamid, c)
 	if err != nil {
 		log.Error("%s", err)
+		c.cancel()
+		s.auditRefused(ft.Network, ft.Address, err.Error())
 
 		fb := NewFrameResult(ft.Streamid, ERR_IDEXIST)
 		err := s.SendFrame(fb)
@@ -270,66 +529,145 @@ func (s *Session) on_syn(ft *FrameSyn) (err error) {
 		return nil
 	}
 
+	s.SynHandler(c)
+	return
+}
+
+// DialHandler connect target of stream, and copy data between them.
+// It is the default SynHandler, used by proxy.
+func (s *Session) DialHandler(c *Conn) {
 	// it may toke long time to connect with target address
 	// so we use goroutine to return back loop
 	go func() {
-		var err error
 		var conn net.Conn
-		log.Debugf("try to connect %s => %s:%s.", c.String(), ft.Network, ft.Address)
+		log.Debugf("try to connect %s => %s:%s.", c.String(), c.Network, c.Address)
 
-		if dialer, ok := s.dialer.(*sutils.TcpDialer); ok {
-			conn, err = dialer.DialTimeout(ft.Network, ft.Address, DIAL_TIMEOUT*time.Second)
-		} else {
-			conn, err = s.dialer.Dial(ft.Network, ft.Address)
+		dialer, network, addrs, err := s.synTarget(c)
+		for _, address := range addrs {
+			conn, err = dialer.DialContext(c.ctx, network, address)
+			if err == nil || c.ctx.Err() != nil {
+				break
+			}
+			log.Infof("%s connect %s failed: %s", c.String(), address, err)
 		}
 
 		if err != nil {
 			log.Error("%s", err)
-			fb := NewFrameResult(ft.Streamid, ERR_CONNFAILED)
-			err = s.SendFrame(fb)
+			// only message of DialError sent, error from dialer may
+			// have details of server, errno is enough for client.
+			var msg string
+			var de *DialError
+			if errors.As(err, &de) {
+				msg = de.Msg
+			}
+			err = c.Refuse(ErrnoFromError(err), msg)
 			if err != nil {
 				log.Error("%s", err)
 			}
-			c.Final()
 			return
 		}
 
-		fb := NewFrameResult(ft.Streamid, ERR_NONE)
-		err = s.SendFrame(fb)
+		err = c.Establish()
 		if err != nil {
 			log.Error("%s", err)
+			conn.Close()
 			return
 		}
-		c.status = ST_EST
 
 		go sutils.CopyLink(conn, c)
-		log.Noticef("connected %s => %s:%s.", c.String(), ft.Network, ft.Address)
+		log.Noticef("connected %s => %s:%s.", c.String(), c.Network, c.Address)
 		return
 	}()
-	return
 }
 
-// ---- syn part ended ----
+// In server, connect target in syn. In client, syn comes from a bind,
+// connect target of the bind. Addresses should be tried in order.
+func (s *Session) synTarget(c *Conn) (dialer sutils.Dialer, network string, addrs []string, err error) {
+	if s.dialer != nil {
+		dialer = s.chooseDialer(c.Address)
+		addrs, err = s.server.CheckACL(c.ctx, s.Username, c.Network, c.Address)
+		if _, ok := dialer.(*sutils.TcpDialer); !ok && err == nil {
+			// keep domain for upstream, let upstream rules match it.
+			addrs = []string{c.Address}
+		}
+		return dialer, c.Network, addrs, err
+	}
 
-// ---- dns part ----
+	cb := s.getBind(c.Address)
+	if cb == nil {
+		return nil, "", nil, &DialError{
+			Errno:   ERR_DENIED,
+			Msg:     "no such bind",
+			Network: c.Network,
+			Address: c.Address,
+		}
+	}
+	return cb.dialer, cb.Network, []string{cb.Target}, nil
+}
 
-func MakeDnsFrame(host string, t uint16, streamid uint16) (req *dns.Msg, f Frame, err error) {
-	log.Debugf("make a dns query for %s.", host)
+// chooseDialer return dialer of server for address, upstream or direct.
+func (s *Session) chooseDialer(address string) sutils.Dialer {
+	if rd, ok := s.dialer.(*sutils.RuleDialer); ok {
+		return rd.Choose(address)
+	}
+	return s.dialer
+}
 
-	req = new(dns.Msg)
-	req.Id = dns.Id()
-	req.SetQuestion(dns.Fqdn(host), t)
-	req.RecursionDesired = true
+// AcceptHandler establish stream, and put it into accept queue.
+func (s *Session) AcceptHandler(c *Conn) {
+	// only sender of acceptch, so it won't be full after checked.
+	s.plock.Lock()
+	ok := !s.closed && len(s.acceptch) < cap(s.acceptch)
+	s.plock.Unlock()
+	if !ok {
+		log.Errorf("%s accept queue full, refuse %s.", s.String(), c.String())
+		go c.Refuse(ERR_CONNFAILED, "accept queue full")
+		return
+	}
 
-	b, err := req.Pack()
+	// Establish write to network, don't hold plock.
+	err := c.Establish()
 	if err != nil {
+		log.Errorf("%s", err)
 		return
 	}
 
-	f = NewFrameDns(streamid, b)
-	return
+	s.plock.Lock()
+	defer s.plock.Unlock()
+	if s.closed {
+		// stream already finaled by Close.
+		return
+	}
+	s.acceptch <- c
+}
+
+// Open a stream to remote. It's useful when remote use AcceptHandler.
+func (s *Session) Open() (net.Conn, error) {
+	c, err := s.Dial("", "")
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
+// Accept wait for and return next stream from remote.
+// Work with AcceptHandler only.
+func (s *Session) Accept() (net.Conn, error) {
+	c, ok := <-s.acceptch
+	if !ok {
+		return nil, ErrSessionClosed
+	}
+	return c, nil
+}
+
+func (s *Session) Addr() net.Addr {
+	return s.LocalAddr()
+}
+
+// ---- syn part ended ----
+
+// ---- dns part ----
+
 func DebugDNS(r *dns.Msg, name string) {
 	straddr := ""
 	for _, a := range r.Answer {
@@ -344,21 +682,88 @@ func DebugDNS(r *dns.Msg, name string) {
 	return
 }
 
-func ParseDnsFrame(f Frame, req *dns.Msg) (addrs []net.IP, err error) {
+// packDns pack dns message, truncate it if larger than a frame.
+func packDns(m *dns.Msg) (b []byte, err error) {
+	for {
+		b, err = m.Pack()
+		if err != nil || len(b) <= MAX_DNS_SIZE {
+			return
+		}
+		// drop records from tail, just like udp truncation.
+		m.Truncated = true
+		switch {
+		case len(m.Extra) > 0:
+			m.Extra = m.Extra[:len(m.Extra)-1]
+		case len(m.Ns) > 0:
+			m.Ns = m.Ns[:len(m.Ns)-1]
+		case len(m.Answer) > 0:
+			m.Answer = m.Answer[:len(m.Answer)-1]
+		default:
+			return nil, ErrDnsMsgIllegal
+		}
+	}
+}
+
+// Exchange send dns query to remote and wait for response.
+// Any type of query can be sent.
+func (s *Session) Exchange(req *dns.Msg) (res *dns.Msg, err error) {
+	b, err := req.Pack()
+	if err != nil {
+		return
+	}
+	if len(b) > MAX_DNS_SIZE {
+		return nil, ErrDnsMsgIllegal
+	}
+
+	// buffered, so session loop will not block if we are gone.
+	cfs := CreateChanFrameSender(1)
+	streamid, err := s.PutIntoNextId(&cfs)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err := s.RemovePort(streamid)
+		if err != nil {
+			log.Error("%s", err.Error())
+		}
+	}()
+
+	err = s.SendFrame(NewFrameDns(streamid, b))
+	if err != nil {
+		return
+	}
+
+	f, err := cfs.RecvWithTimeout(DNS_TIMEOUT * time.Second)
+	if err != nil {
+		return
+	}
 	ft, ok := f.(*FrameDns)
 	if !ok {
 		return nil, ErrDnsMsgIllegal
 	}
 
-	res := new(dns.Msg)
+	res = new(dns.Msg)
 	err = res.Unpack(ft.Data)
 	if err != nil || !res.Response || res.Id != req.Id {
 		return nil, ErrDnsMsgIllegal
 	}
 
-	if DEBUGDNS {
+	if DEBUGDNS && len(req.Question) > 0 {
 		DebugDNS(res, req.Question[0].Name)
 	}
+	return
+}
+
+func (s *Session) query(host string, t uint16) (addrs []net.IP, err error) {
+	log.Debugf("make a dns query for %s.", host)
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(host), t)
+	req.RecursionDesired = true
+
+	res, err := s.Exchange(req)
+	if err != nil {
+		return
+	}
 	for _, a := range res.Answer {
 		switch ta := a.(type) {
 		case *dns.A:
@@ -370,40 +775,54 @@ func ParseDnsFrame(f Frame, req *dns.Msg) (addrs []net.IP, err error) {
 	return
 }
 
+// LookupIP query A and AAAA at the same time, ipv4 addresses come first.
+// Fail only if both failed.
 func (s *Session) LookupIP(host string) (addrs []net.IP, err error) {
 	ip := net.ParseIP(host)
 	if ip != nil {
 		return []net.IP{ip}, nil
 	}
 
-	cfs := CreateChanFrameSender(0)
-	streamid, err := s.PutIntoNextId(&cfs)
-	if err != nil {
-		return
-	}
-	defer func() {
-		err := s.RemovePort(streamid)
-		if err != nil {
-			log.Error("%s", err.Error())
-		}
+	var addrs6 []net.IP
+	var err6 error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		addrs6, err6 = s.query(host, dns.TypeAAAA)
 	}()
 
-	req, freq, err := MakeDnsFrame(host, dns.TypeA, streamid)
-	if err != nil {
+	addrs, err = s.query(host, dns.TypeA)
+	<-done
+
+	if err != nil && err6 != nil {
 		return
 	}
+	return append(addrs, addrs6...), nil
+}
 
-	err = s.SendFrame(freq)
-	if err != nil {
-		return
+// exchanger can answer dns query, like upstream pool.
+type exchanger interface {
+	Exchange(req *dns.Msg) (*dns.Msg, error)
+}
+
+// exchange answer req by upstream if rules of server choose upstream for
+// the name, or by r. Blocked names never go to upstream.
+func (s *Session) exchange(r *Resolver, req *dns.Msg) (res *dns.Msg) {
+	if s.dialer == nil || len(req.Question) != 1 || r.blocked(req.Question[0].Name) {
+		return r.Exchange(req)
+	}
+	host := strings.TrimSuffix(req.Question[0].Name, ".")
+	ex, ok := s.chooseDialer(net.JoinHostPort(host, "")).(exchanger)
+	if !ok {
+		return r.Exchange(req)
 	}
 
-	fres, err := cfs.RecvWithTimeout(DNS_TIMEOUT * time.Second)
+	res, err := ex.Exchange(req)
 	if err != nil {
-		return
+		log.Errorf("dns query for %s by upstream failed: %s", host, err)
+		res = new(dns.Msg)
+		res.SetRcode(req, dns.RcodeServerFailure)
 	}
-
-	addrs, err = ParseDnsFrame(fres, req)
 	return
 }
 
@@ -420,31 +839,35 @@ func (s *Session) on_dns(ft *FrameDns) (err error) {
 		return s.sendFrameInChan(ft)
 	}
 
-	log.Infof("dns query for %s.", req.Question[0].Name)
-
-	d, ok := sutils.DefaultLookuper.(*sutils.DnsLookup)
-	if !ok {
-		return ErrNoDnsServer
-	}
-	res, err := d.Exchange(req)
-	if err != nil {
-		log.Error("%s", err.Error())
-		return nil
+	if len(req.Question) > 0 {
+		log.Infof("dns query for %s.", req.Question[0].Name)
 	}
 
-	if DEBUGDNS {
-		DebugDNS(res, req.Question[0].Name)
+	r := defaultResolver
+	if s.server != nil && s.server.Resolver != nil {
+		r = s.server.Resolver
 	}
 
-	// send response back from streamid
-	b, err := res.Pack()
-	if err != nil {
-		log.Error("%s", ErrDnsMsgIllegal.Error())
-		return nil
-	}
+	// query may take long time, don't block session loop.
+	go func() {
+		res := s.exchange(r, req)
+		if DEBUGDNS && len(req.Question) > 0 {
+			DebugDNS(res, req.Question[0].Name)
+		}
 
-	fr := NewFrameDns(ft.GetStreamid(), b)
-	err = s.SendFrame(fr)
+		// send response back from streamid
+		b, err := packDns(res)
+		if err != nil {
+			log.Error("%s", ErrDnsMsgIllegal.Error())
+			return
+		}
+
+		fr := NewFrameDns(ft.GetStreamid(), b)
+		err = s.SendFrame(fr)
+		if err != nil {
+			log.Errorf("%s", err)
+		}
+	}()
 	return
 }
 
@@ -0,0 +1,498 @@
+package msocks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/shell909090/goproxy/sutils"
+)
+
+func TestMuxSession(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMuxSession(c1, false)
+	server := NewMuxSession(c2, true)
+	go client.Run()
+	go server.Run()
+	defer client.Close()
+
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := client.Open()
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+
+	data := []byte("hello, msocks")
+	_, err = conn.Write(data)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if bytes.Compare(buf, data) != 0 {
+		t.Fatalf("echo data wrong")
+	}
+	conn.Close()
+
+	server.Close()
+	_, err = server.Accept()
+	if err != ErrSessionClosed {
+		t.Fatalf("Accept after close should fail")
+	}
+}
+
+func TestPackDnsTruncate(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeTXT)
+	txt := strings.Repeat("a", 255)
+	for i := 0; i < 300; i++ {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{txt},
+		})
+	}
+
+	b, err := packDns(m)
+	if err != nil {
+		t.Fatalf("pack failed: %s", err)
+	}
+	if len(b) > MAX_DNS_SIZE || !m.Truncated || len(m.Answer) == 0 {
+		t.Fatalf("dns message not truncated right")
+	}
+}
+
+func TestResultFrameOldClient(t *testing.T) {
+	s := &Session{}
+	f := s.resultFrame(1, ERR_REFUSED, "refused")
+	if f.Length != 4 || f.Message != "" {
+		t.Fatalf("old client should not get message in result")
+	}
+
+	s.resultmsg = true
+	f = s.resultFrame(1, ERR_REFUSED, "refused")
+	if f.Message != "refused" {
+		t.Fatalf("message lost in result")
+	}
+}
+
+func TestAuthResultMsg(t *testing.T) {
+	ms, err := NewServer(nil, sutils.DefaultTcpDialer)
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+
+	// old client send auth with streamid 0.
+	for _, caps := range []uint16{CAP_RESULTMSG, 0} {
+		c1, c2 := net.Pipe()
+		go func() {
+			buf, _ := NewFrameAuth(caps, "", "").Packed()
+			c1.Write(buf.Bytes())
+			ReadFrame(c1)
+		}()
+		auth, err := ms.OnAuth(c2)
+		if err != nil {
+			t.Fatalf("OnAuth failed: %s", err)
+		}
+		if auth.Streamid&CAP_RESULTMSG != caps {
+			t.Fatalf("capability of client lost: %d", auth.Streamid)
+		}
+		// new client may not report version.
+		if auth.Version != "" {
+			t.Fatalf("version should be empty: %s", auth.Version)
+		}
+		c1.Close()
+	}
+}
+
+// holdDialer hold dials in channel, test answer them by ret.
+type holdDialer struct {
+	dials chan *holdDial
+}
+
+type holdDial struct {
+	ctx     context.Context
+	network string
+	address string
+	peer    net.Conn
+	ret     chan error
+}
+
+func (hd *holdDialer) Dial(network, address string) (net.Conn, error) {
+	return hd.DialContext(context.Background(), network, address)
+}
+
+func (hd *holdDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	d := &holdDial{ctx: ctx, network: network, address: address, peer: c2, ret: make(chan error, 1)}
+	hd.dials <- d
+	select {
+	case err := <-d.ret:
+		if err != nil {
+			return nil, err
+		}
+		return c1, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// newHoldPair create sessions, dials in server are held in channel
+// without answer, so test can control when result go back.
+func newHoldPair() (client, server *Session, dials chan *holdDial) {
+	c1, c2 := net.Pipe()
+	dials = make(chan *holdDial, 4)
+	client = NewSession(c1)
+	server = NewSession(c2)
+	server.next_id = 1
+	server.dialer = &holdDialer{dials: dials}
+	go client.Run()
+	go server.Run()
+	return
+}
+
+func waitSize(s *Session, n int) bool {
+	for i := 0; i < 100; i++ {
+		if s.GetSize() == n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestFastOpenCancel(t *testing.T) {
+	client, server, dials := newHoldPair()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := client.DialFastContext(ctx, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("DialFast failed: %s", err)
+	}
+	d := <-dials
+	cancel()
+
+	// rst from client cancel dial in server.
+	select {
+	case <-d.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("dial in server not canceled")
+	}
+	if !waitSize(server, 0) || !waitSize(client, 0) {
+		t.Fatalf("stream not reset after dial canceled")
+	}
+	_, err = c.Write([]byte("data"))
+	if err == nil {
+		t.Fatalf("write to canceled stream should fail")
+	}
+}
+
+func TestFastOpenFinBeforeResult(t *testing.T) {
+	client, server, dials := newHoldPair()
+	defer client.Close()
+	defer server.Close()
+
+	c, err := client.DialFast("tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("DialFast failed: %s", err)
+	}
+	data := []byte("hello")
+	_, err = c.Write(data)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	c.Close()
+
+	d := <-dials
+	d.ret <- nil
+	buf, err := ioutil.ReadAll(d.peer)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if bytes.Compare(buf, data) != 0 {
+		t.Fatalf("data written before result lost")
+	}
+	d.peer.Close()
+
+	if !waitSize(server, 0) || !waitSize(client, 0) {
+		t.Fatalf("stream not closed")
+	}
+}
+
+func TestFastOpenRefused(t *testing.T) {
+	client, server, dials := newHoldPair()
+	defer client.Close()
+	defer server.Close()
+
+	c, err := client.DialFast("tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("DialFast failed: %s", err)
+	}
+	d := <-dials
+	d.ret <- syscall.ECONNREFUSED
+
+	_, err = c.Read(make([]byte, 1))
+	de, ok := err.(*DialError)
+	if !ok || de.Errno != ERR_REFUSED {
+		t.Fatalf("read should get refused, got %v", err)
+	}
+	if err = c.WaitDial(); err == nil {
+		t.Fatalf("WaitDial should fail after refused")
+	}
+	if !waitSize(client, 0) {
+		t.Fatalf("stream not removed")
+	}
+}
+
+func TestFastOpenWaitDial(t *testing.T) {
+	client, server, dials := newHoldPair()
+	defer client.Close()
+	defer server.Close()
+
+	c, err := client.DialFast("tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("DialFast failed: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.WaitDial()
+	}()
+
+	d := <-dials
+	select {
+	case <-done:
+		t.Fatalf("WaitDial returned before result")
+	case <-time.After(50 * time.Millisecond):
+	}
+	d.ret <- nil
+	if err = <-done; err != nil {
+		t.Fatalf("WaitDial failed: %s", err)
+	}
+}
+
+// result may come before SendSyn return, it should never be missed.
+func TestResultBeforeWait(t *testing.T) {
+	c1, _ := net.Pipe()
+	s := NewSession(c1)
+	c := NewConn(ST_SYN_SENT, 1, s, "tcp", "example.com:80")
+	s.PutIntoId(1, c)
+	c.CloseFrame()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.WaitResult(context.Background())
+	}()
+	select {
+	case err := <-done:
+		if de, ok := err.(*DialError); !ok || de.Errno != ERR_CLOSED {
+			t.Fatalf("WaitResult should get closed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("WaitResult missed session closed")
+	}
+}
+
+// serverDialer connect to ms by net.Pipe.
+type serverDialer struct {
+	ms *MsocksServer
+}
+
+func (sd *serverDialer) Dial(network, address string) (net.Conn, error) {
+	return sd.DialContext(context.Background(), network, address)
+}
+
+func (sd *serverDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	go sd.ms.Handler(c2)
+	return c1, nil
+}
+
+// oldServerDialer connect to a server which echo streamid of auth, like
+// old versions, dials of it are held in dials.
+type oldServerDialer struct {
+	dials chan *holdDial
+}
+
+func (od *oldServerDialer) Dial(network, address string) (net.Conn, error) {
+	return od.DialContext(context.Background(), network, address)
+}
+
+func (od *oldServerDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	go func() {
+		f, err := ReadFrame(c2)
+		if err != nil {
+			return
+		}
+		buf, _ := NewFrameResult(f.GetStreamid(), ERR_NONE).Packed()
+		c2.Write(buf.Bytes())
+		s := NewSession(c2)
+		s.next_id = 1
+		s.dialer = &holdDialer{dials: od.dials}
+		s.Run()
+	}()
+	return c1, nil
+}
+
+func TestDatagramOldServer(t *testing.T) {
+	ms, err := NewServer(nil, sutils.DefaultTcpDialer)
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+	sf := &SessionFactory{Dialer: &serverDialer{ms: ms}, serveraddr: "server"}
+	s, err := sf.CreateSession()
+	if err != nil {
+		t.Fatalf("CreateSession failed: %s", err)
+	}
+	s.Close()
+	if !s.datagram {
+		t.Fatalf("new server should accept datagram")
+	}
+
+	od := &oldServerDialer{dials: make(chan *holdDial, 1)}
+	sp := CreateSessionPool(0, 0)
+	sp.AddSessionFactory(od, "server", "", "")
+	defer sp.CutAll()
+	s, err = sp.Get()
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	if s.datagram {
+		t.Fatalf("old server should not accept datagram")
+	}
+	if _, err = s.ListenDatagram(); err != ErrNoDatagram {
+		t.Fatalf("ListenDatagram to old server should fail, got %v", err)
+	}
+
+	// udp go through stream, as old version did.
+	go sp.Dial("udp", "example.com:53")
+	select {
+	case d := <-od.dials:
+		if d.network != "udp" || d.address != "example.com:53" {
+			t.Fatalf("dial wrong: %s %s", d.network, d.address)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("udp to old server should be dialed by stream")
+	}
+}
+
+func TestThrottleNotBlockSession(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMuxSession(c1, false)
+	server := NewMuxSession(c2, true)
+	server.server = &MsocksServer{}
+	server.usage = NewUsage(&Limit{Download: 1024})
+	go client.Run()
+	go server.Run()
+	defer client.Close()
+	defer server.Close()
+
+	open := func() (c, sc net.Conn) {
+		c, err := client.Open()
+		if err != nil {
+			t.Fatalf("Open failed: %s", err)
+		}
+		sc, err = server.Accept()
+		if err != nil {
+			t.Fatalf("Accept failed: %s", err)
+		}
+		return
+	}
+	ca, sa := open()
+	cb, sb := open()
+
+	// stream a is throttled for seconds.
+	go sa.Write(make([]byte, 64*1024))
+	time.Sleep(100 * time.Millisecond)
+	// rst of a will be handled in session loop.
+	ca.(*Conn).Abort()
+
+	start := time.Now()
+	_, err := cb.Write([]byte("ping"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(sb, buf)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("stream delayed %s by another throttled stream", d)
+	}
+}
+
+func TestDatagramBudget(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMuxSession(c1, false)
+	server := NewMuxSession(c2, true)
+	server.server = &MsocksServer{Resolver: NewResolver(), MaxSockets: 1}
+	server.dialer = sutils.DefaultTcpDialer
+	client.budget = NewMemBudget(100, nil)
+	go client.Run()
+	go server.Run()
+	defer client.Close()
+
+	dc, err := client.ListenDatagram()
+	if err != nil {
+		t.Fatalf("ListenDatagram failed: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		f, err := NewFrameUdp(0, "peer", dc.src, make([]byte, 60))
+		if err != nil {
+			t.Fatalf("NewFrameUdp failed: %s", err)
+		}
+		server.SendFrame(f)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := client.budget.GetUsed(); n != 60 {
+		t.Fatalf("datagrams over budget should be dropped, used %d", n)
+	}
+	buf := make([]byte, 100)
+	if _, _, err = dc.ReadFrom(buf); err != nil {
+		t.Fatalf("ReadFrom failed: %s", err)
+	}
+	if n := client.budget.GetUsed(); n != 0 {
+		t.Fatalf("budget should be released after read, used %d", n)
+	}
+
+	// second flow is refused by socket limit of server.
+	for i := 0; i < 2; i++ {
+		dc, err := client.ListenDatagram()
+		if err != nil {
+			t.Fatalf("ListenDatagram failed: %s", err)
+		}
+		dc.WriteTo([]byte("ping"), DatagramAddr("127.0.0.1:9"))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := server.server.GetSockets(); n != 1 {
+		t.Fatalf("sockets should be limited to 1, got %d", n)
+	}
+	server.Close()
+	for i := 0; i < 10 && server.server.GetSockets() != 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := server.server.GetSockets(); n != 0 {
+		t.Fatalf("sockets should be released after session closed, got %d", n)
+	}
+}
@@ -17,20 +17,34 @@ type Updater interface {
 }
 
 var (
-	mu_set     sync.Mutex
-	update_set map[Updater]struct{}
+	mu_set      sync.Mutex
+	update_set  map[Updater]struct{}
+	update_stop chan struct{}
+	stop_once   sync.Once
 )
 
 func init() {
 	update_set = make(map[Updater]struct{}, 0)
+	update_stop = make(chan struct{})
 	go func() {
 		for {
-			time.Sleep(time.Duration(UPDATE_INTERVAL) * time.Second)
-			update_all()
+			select {
+			case <-time.After(time.Duration(UPDATE_INTERVAL) * time.Second):
+				update_all()
+			case <-update_stop:
+				return
+			}
 		}
 	}()
 }
 
+// StopUpdater stop updating all counters, should be called when quit.
+func StopUpdater() {
+	stop_once.Do(func() {
+		close(update_stop)
+	})
+}
+
 func update_all() {
 	mu_set.Lock()
 	defer mu_set.Unlock()
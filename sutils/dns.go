@@ -9,6 +9,7 @@ import (
 type DnsLookup struct {
 	Servers []string
 	c       *dns.Client
+	tcp     *dns.Client
 }
 
 func NewDnsLookup(Servers []string, dnsnet string) (d *DnsLookup) {
@@ -17,12 +18,18 @@ func NewDnsLookup(Servers []string, dnsnet string) (d *DnsLookup) {
 	}
 	d.c = new(dns.Client)
 	d.c.Net = dnsnet
+	d.tcp = new(dns.Client)
+	d.tcp.Net = "tcp"
 	return d
 }
 
 func (d *DnsLookup) Exchange(m *dns.Msg) (r *dns.Msg, err error) {
 	for _, srv := range d.Servers {
 		r, _, err = d.c.Exchange(m, srv)
+		if err == nil && r.Truncated && d.c.Net != "tcp" {
+			// response too large for udp, try again in tcp.
+			r, _, err = d.tcp.Exchange(m, srv)
+		}
 		if err != nil {
 			continue
 		}
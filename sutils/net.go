@@ -1,6 +1,7 @@
 package sutils
 
 import (
+	"context"
 	"net"
 	"time"
 
@@ -9,6 +10,7 @@ import (
 
 type Dialer interface {
 	Dial(string, string) (net.Conn, error)
+	DialContext(context.Context, string, string) (net.Conn, error)
 }
 
 type TcpDialer struct {
@@ -18,6 +20,11 @@ func (td *TcpDialer) Dial(network, address string) (net.Conn, error) {
 	return net.Dial(network, address)
 }
 
+func (td *TcpDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
 func (td *TcpDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
 	return net.DialTimeout(network, address, timeout)
 }
@@ -0,0 +1,82 @@
+package sutils
+
+import (
+	"context"
+	"net"
+	"path"
+	"strings"
+)
+
+// MatchHostRule check host and port with rule. Rule can be a domain, matches
+// itself and all subdomains, or a glob pattern like "*.example.com", or a CIDR,
+// matches ip host in it, or an ip, or ":port", or "domain:port", or
+// "ip:port" ("[ipv6]:port" for ipv6). Domains are matched case-insensitively,
+// trailing dot ignored.
+func MatchHostRule(rule, host, port string) bool {
+	if _, ipnet, err := net.ParseCIDR(rule); err == nil {
+		ip := net.ParseIP(host)
+		return ip != nil && ipnet.Contains(ip)
+	}
+
+	rhost, rport := rule, ""
+	switch {
+	case net.ParseIP(rule) != nil:
+	case strings.HasPrefix(rule, "["):
+		var err error
+		rhost, rport, err = net.SplitHostPort(rule)
+		if err != nil {
+			return false
+		}
+	default:
+		if idx := strings.LastIndex(rule, ":"); idx != -1 {
+			rhost, rport = rule[:idx], rule[idx+1:]
+		}
+	}
+	if rport != "" && rport != port {
+		return false
+	}
+	if rhost == "" {
+		return true
+	}
+	if rip := net.ParseIP(rhost); rip != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && ip.Equal(rip)
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	rhost = strings.TrimSuffix(strings.ToLower(rhost), ".")
+	if strings.ContainsAny(rhost, "*?[") {
+		ok, _ := path.Match(rhost, host)
+		return ok
+	}
+	return host == rhost || strings.HasSuffix(host, "."+rhost)
+}
+
+// RuleDialer dial by Matched if address match any of rules, or by Default.
+type RuleDialer struct {
+	Rules   []string
+	Matched Dialer
+	Default Dialer
+}
+
+// Choose return dialer will be used for address.
+func (rd *RuleDialer) Choose(address string) Dialer {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return rd.Default
+	}
+	for _, rule := range rd.Rules {
+		if MatchHostRule(rule, host, port) {
+			return rd.Matched
+		}
+	}
+	return rd.Default
+}
+
+func (rd *RuleDialer) Dial(network, address string) (net.Conn, error) {
+	return rd.Choose(address).Dial(network, address)
+}
+
+func (rd *RuleDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return rd.Choose(address).DialContext(ctx, network, address)
+}